@@ -0,0 +1,710 @@
+package worm
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// builtinCommands are handled by the server rather than the context, mapped to the ACL
+// categories they belong to
+var builtinCommands = map[string][]string{
+	"hello":        {"fast", "connection"},
+	"auth":         {"fast", "connection"},
+	"command":      {"slow", "connection"},
+	"ping":         {"fast", "connection"},
+	"quit":         {"fast", "connection"},
+	"subscribe":    {"slow", "pubsub"},
+	"psubscribe":   {"slow", "pubsub"},
+	"unsubscribe":  {"slow", "pubsub"},
+	"punsubscribe": {"slow", "pubsub"},
+	"publish":      {"fast", "pubsub"},
+	"multi":        {"fast", "transaction"},
+	"exec":         {"slow", "transaction"},
+	"discard":      {"fast", "transaction"},
+	"watch":        {"fast", "transaction"},
+	"unwatch":      {"fast", "transaction"},
+	"acl":          {"slow", "admin", "dangerous"},
+	"reset":        {"fast", "connection"},
+}
+
+func isBuiltinCommand(cmd string) bool {
+	_, ok := builtinCommands[cmd]
+	return ok
+}
+
+var errNoPermissionKeys = errors.New("NOPERM this user has no permissions to access one of the keys used as arguments")
+
+// newACLUser returns a user created by ACL SETUSER, new users are disabled and can't
+// run any commands or access any keys
+func newACLUser(name string) User {
+	return User{
+		Name:     name,
+		Disabled: true,
+		Keys:     []string{},
+		Commands: []string{},
+	}
+}
+
+func copyStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+
+	return append([]string{}, s...)
+}
+
+func (u User) clone() User {
+	u.Passwords = copyStrings(u.Passwords)
+	u.Permissions = copyStrings(u.Permissions)
+	u.Commands = copyStrings(u.Commands)
+	u.Keys = copyStrings(u.Keys)
+	return u
+}
+
+// SetRules applies ACL rules such as "on", ">password", "~cache:*" or "-@write" in order
+func (u *User) SetRules(rules ...string) error {
+	for _, rule := range rules {
+		if err := u.setRule(rule); err != nil {
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': %s", rule, err)
+		}
+	}
+
+	return nil
+}
+
+func (u *User) setRule(rule string) error {
+	lower := strings.ToLower(rule)
+
+	switch {
+	case lower == "on":
+		u.Disabled = false
+	case lower == "off":
+		u.Disabled = true
+	case lower == "nopass":
+		u.NoPass = true
+		u.Password = ""
+		u.Passwords = nil
+	case lower == "resetpass":
+		u.NoPass = false
+		u.Password = ""
+		u.Passwords = nil
+	case lower == "allkeys":
+		u.Keys = []string{"*"}
+	case lower == "resetkeys":
+		u.Keys = []string{}
+	case lower == "allcommands":
+		u.Commands = []string{"+@all"}
+		u.Permissions = nil
+	case lower == "nocommands":
+		u.Commands = []string{"-@all"}
+		u.Permissions = nil
+	case lower == "reset":
+		*u = newACLUser(u.Name)
+	case strings.HasPrefix(rule, ">"):
+		u.addPassword(HashPassword(rule[1:]))
+	case strings.HasPrefix(rule, "#"):
+		if !validPasswordHash(rule[1:]) {
+			return errors.New("The password hash must be a SHA-256 hash of exactly 64 lowercase hexadecimal characters or a bcrypt hash with a cost of at most 14")
+		}
+		u.addPassword(rule[1:])
+	case strings.HasPrefix(rule, "<"):
+		if !u.removePassword(rule[1:], false) {
+			return errors.New("no such password")
+		}
+	case strings.HasPrefix(rule, "!"):
+		if !u.removePassword(rule[1:], true) {
+			return errors.New("no such password")
+		}
+	case strings.HasPrefix(rule, "~"):
+		// Users without key rules can access every key, the first pattern restricts them
+		if u.Keys == nil {
+			u.Keys = []string{}
+		}
+		u.Keys = append(u.Keys, rule[1:])
+	case strings.HasPrefix(rule, "+") || strings.HasPrefix(rule, "-"):
+		if len(rule) == 1 || lower == "+@" || lower == "-@" {
+			return errors.New("Syntax error")
+		}
+
+		// +@all and -@all replace all previous command rules
+		if lower[1:] == "@all" {
+			u.Commands = []string{lower}
+			u.Permissions = nil
+			return nil
+		}
+
+		u.initCommands()
+		u.Commands = append(u.Commands, lower)
+	default:
+		return errors.New("Syntax error")
+	}
+
+	return nil
+}
+
+// initCommands converts Permissions into command rules the first time they're changed
+func (u *User) initCommands() {
+	if u.Commands != nil {
+		return
+	}
+
+	u.Commands = []string{"+@all"}
+	if len(u.Permissions) > 0 {
+		u.Commands = []string{"-@all"}
+		for _, p := range u.Permissions {
+			u.Commands = append(u.Commands, "+"+strings.ToLower(p))
+		}
+	}
+
+	u.Permissions = nil
+}
+
+func (u *User) addPassword(hash string) {
+	u.NoPass = false
+
+	for _, p := range u.Passwords {
+		if p == hash {
+			return
+		}
+	}
+
+	u.Passwords = append(u.Passwords, hash)
+}
+
+// removePassword removes a password, or a password hash if hashed is true
+func (u *User) removePassword(password string, hashed bool) bool {
+	found := false
+
+	if u.Password != "" && (u.Password == password || hashed && HashPassword(u.Password) == password) {
+		u.Password = ""
+		found = true
+	}
+
+	sum := sha256.Sum256([]byte(password))
+
+	passwords := []string{}
+	for _, p := range u.Passwords {
+		if p == password && hashed || !hashed && verifyPassword(p, password, sum) {
+			found = true
+		} else {
+			passwords = append(passwords, p)
+		}
+	}
+	u.Passwords = passwords
+
+	return found
+}
+
+// checkPassword compares a password against all of the user's passwords in constant time
+func (u *User) checkPassword(password string) bool {
+	if u.NoPass {
+		return true
+	}
+
+	sum := sha256.Sum256([]byte(password))
+	ok := false
+
+	if u.Password != "" {
+		expected := sha256.Sum256([]byte(u.Password))
+		if subtle.ConstantTimeCompare(expected[:], sum[:]) == 1 {
+			ok = true
+		}
+	}
+
+	for _, hash := range u.Passwords {
+		if verifyPassword(hash, password, sum) {
+			ok = true
+		}
+	}
+
+	return ok
+}
+
+// can returns true if the user is allowed to run a command in the given categories,
+// the last matching rule wins
+func (u *User) can(cmd string, categories []string) bool {
+	if u.Commands == nil {
+		if len(u.Permissions) == 0 {
+			return true
+		}
+
+		for _, x := range u.Permissions {
+			if cmd == strings.ToLower(x) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	allowed := false
+	for _, rule := range u.Commands {
+		name := rule[1:]
+
+		match := name == cmd || name == "@all"
+		if !match && strings.HasPrefix(name, "@") {
+			for _, c := range categories {
+				if name[1:] == c {
+					match = true
+					break
+				}
+			}
+		}
+
+		if match {
+			allowed = rule[0] == '+'
+		}
+	}
+
+	return allowed
+}
+
+func (u *User) canAccessKey(key string) bool {
+	if u.Keys == nil {
+		return true
+	}
+
+	for _, pattern := range u.Keys {
+		if globMatch(pattern, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (u *User) flags() []string {
+	flags := []string{"on"}
+	if u.Disabled {
+		flags[0] = "off"
+	}
+
+	if u.NoPass {
+		flags = append(flags, "nopass")
+	}
+
+	return flags
+}
+
+// passwords returns the hashes of the user's passwords
+func (u *User) passwords() []string {
+	passwords := []string{}
+	if u.Password != "" {
+		passwords = append(passwords, HashPassword(u.Password))
+	}
+
+	return append(passwords, u.Passwords...)
+}
+
+func (u *User) keyRules() []string {
+	if u.Keys == nil {
+		return []string{"~*"}
+	}
+
+	rules := []string{}
+	for _, k := range u.Keys {
+		rules = append(rules, "~"+k)
+	}
+
+	return rules
+}
+
+func (u *User) commandRules() []string {
+	c := User{Commands: u.Commands, Permissions: u.Permissions}
+	c.initCommands()
+
+	if len(c.Commands) == 0 {
+		return []string{"-@all"}
+	}
+
+	return c.Commands
+}
+
+// Rules returns the ACL rules describing the user, in the format used by ACL LIST
+func (u *User) Rules() []string {
+	rules := u.flags()
+
+	for _, p := range u.passwords() {
+		rules = append(rules, "#"+p)
+	}
+
+	rules = append(rules, u.keyRules()...)
+	return append(rules, u.commandRules()...)
+}
+
+// GetUser returns a copy of a user
+func (s *Server) GetUser(name string) (User, bool) {
+	s.usersLock.RLock()
+	defer s.usersLock.RUnlock()
+
+	u, ok := s.Users[name]
+	return u.clone(), ok
+}
+
+// SetUser adds or replaces a user, this should be used instead of modifying Users while
+// the server is running
+func (s *Server) SetUser(user User) {
+	s.usersLock.Lock()
+	defer s.usersLock.Unlock()
+
+	s.Users[user.Name] = user.clone()
+}
+
+// DeleteUser removes a user, connections authenticated as the user are no longer able
+// to run commands
+func (s *Server) DeleteUser(name string) bool {
+	s.usersLock.Lock()
+	defer s.usersLock.Unlock()
+
+	_, ok := s.Users[name]
+	delete(s.Users, name)
+	return ok
+}
+
+// SetUserRules applies ACL rules to a user, creating the user if it doesn't exist. The
+// user is left unchanged if any of the rules are invalid
+func (s *Server) SetUserRules(name string, rules ...string) error {
+	return s.setUserRules(name, false, rules)
+}
+
+// setUserRules applies ACL rules to a user, when implicitDefault is set and there aren't
+// any users the default user is created with full access first. Connections are
+// authenticated as the default user until users are added, like Redis they keep working
+// when the first user is added using ACL SETUSER
+func (s *Server) setUserRules(name string, implicitDefault bool, rules []string) error {
+	s.usersLock.Lock()
+	defer s.usersLock.Unlock()
+
+	implicitDefault = implicitDefault && len(s.Users) == 0 && s.DefaultUser != ""
+
+	u, ok := s.Users[name]
+	if ok {
+		u = u.clone()
+	} else if implicitDefault && name == s.DefaultUser {
+		u = s.newDefaultUser()
+	} else {
+		u = newACLUser(name)
+	}
+
+	if err := u.SetRules(rules...); err != nil {
+		return err
+	}
+
+	if implicitDefault && name != s.DefaultUser {
+		s.Users[s.DefaultUser] = s.newDefaultUser()
+	}
+
+	s.Users[name] = u
+	return nil
+}
+
+// newDefaultUser returns the default user every connection is authenticated as when
+// there aren't any users
+func (s *Server) newDefaultUser() User {
+	u := newACLUser(s.DefaultUser)
+	u.SetRules("on", "nopass", "allkeys", "allcommands")
+	return u
+}
+
+// categories returns the ACL categories of a command
+func (s *Server) categories(cmd string) []string {
+	if c, ok := builtinCommands[cmd]; ok {
+		return c
+	}
+
+	spec := s.Specs[cmd]
+
+	categories := []string{"write"}
+	if spec.ReadOnly {
+		categories[0] = "read"
+	}
+
+	return append(categories, spec.Categories...)
+}
+
+// checkPermissions returns an error if the client's user isn't allowed to run a command
+// with the given arguments
+func (s *Server) checkPermissions(client *Client, cmd string, args []*Value) error {
+	if client.User == nil || noAuthCommands[cmd] {
+		return nil
+	}
+
+	s.usersLock.RLock()
+	defer s.usersLock.RUnlock()
+
+	if len(s.Users) == 0 {
+		return nil
+	}
+
+	u, ok := s.Users[client.User.Name]
+	if !ok || !u.can(cmd, s.categories(cmd)) {
+		return fmt.Errorf("NOPERM this user has no permissions to run the '%s' command", cmd)
+	}
+
+	for _, key := range s.Specs[cmd].Keys(args) {
+		if !u.canAccessKey(key) {
+			return errNoPermissionKeys
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) userNames() []string {
+	s.usersLock.RLock()
+	defer s.usersLock.RUnlock()
+
+	names := make([]string, 0, len(s.Users))
+	for name := range s.Users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (s *Server) aclList() []string {
+	names := s.userNames()
+
+	s.usersLock.RLock()
+	defer s.usersLock.RUnlock()
+
+	lines := []string{}
+	for _, name := range names {
+		u, ok := s.Users[name]
+		if ok {
+			lines = append(lines, "user "+name+" "+strings.Join(u.Rules(), " "))
+		}
+	}
+
+	return lines
+}
+
+// SaveACL writes all users to an ACL file
+func (s *Server) SaveACL(path string) error {
+	data := strings.Join(s.aclList(), "\n") + "\n"
+
+	// The file is replaced atomically so a failed write doesn't lose any users
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(data), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// LoadACL replaces all users with the users in an ACL file, the existing users are kept
+// if the file contains any errors
+func (s *Server) LoadACL(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	users := map[string]User{}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) < 2 || fields[0] != "user" {
+			return fmt.Errorf("%s:%d: should start with user keyword", path, i+1)
+		}
+
+		name := fields[1]
+		if _, ok := users[name]; ok {
+			return fmt.Errorf("%s:%d: duplicate user '%s'", path, i+1, name)
+		}
+
+		u := newACLUser(name)
+		if err := u.SetRules(fields[2:]...); err != nil {
+			return fmt.Errorf("%s:%d: %s", path, i+1, err)
+		}
+
+		users[name] = u
+	}
+
+	s.usersLock.Lock()
+	s.Users = users
+	s.usersLock.Unlock()
+
+	return nil
+}
+
+func (s *Server) aclCategories() []string {
+	seen := map[string]bool{"read": true, "write": true}
+
+	for _, categories := range builtinCommands {
+		for _, c := range categories {
+			seen[c] = true
+		}
+	}
+
+	for _, spec := range s.Specs {
+		for _, c := range spec.Categories {
+			seen[c] = true
+		}
+	}
+
+	categories := []string{}
+	for c := range seen {
+		categories = append(categories, c)
+	}
+	sort.Strings(categories)
+
+	return categories
+}
+
+func (s *Server) aclCategoryCommands(category string) []string {
+	names := []string{}
+
+	for cmd := range builtinCommands {
+		names = append(names, cmd)
+	}
+
+	for cmd := range s.Commands {
+		if _, ok := builtinCommands[cmd]; !ok {
+			names = append(names, cmd)
+		}
+	}
+
+	commands := []string{}
+	for _, cmd := range names {
+		for _, c := range s.categories(cmd) {
+			if c == category {
+				commands = append(commands, cmd)
+				break
+			}
+		}
+	}
+	sort.Strings(commands)
+
+	return commands
+}
+
+func stringValues(s []string) *Value {
+	values := make([]*Value, len(s))
+	for i, x := range s {
+		values[i] = NewString(x)
+	}
+
+	return NewArray(values)
+}
+
+func (s *Server) handleACL(client *Client, args []*Value) {
+	if len(args) == 0 {
+		client.WriteError("wrong number of arguments for 'acl' command")
+		return
+	}
+
+	sub := strings.ToLower(args[0].ToString())
+	args = args[1:]
+
+	switch sub {
+	case "setuser":
+		if len(args) == 0 {
+			client.WriteError("wrong number of arguments for 'acl|setuser' command")
+			return
+		}
+
+		rules := make([]string, len(args)-1)
+		for i, arg := range args[1:] {
+			rules[i] = arg.ToString()
+		}
+
+		if err := s.setUserRules(args[0].ToString(), true, rules); err != nil {
+			client.WriteError(err.Error())
+			return
+		}
+
+		client.WriteOK()
+	case "getuser":
+		if len(args) != 1 {
+			client.WriteError("wrong number of arguments for 'acl|getuser' command")
+			return
+		}
+
+		u, ok := s.GetUser(args[0].ToString())
+		if !ok {
+			client.WriteValue(NewNil())
+			return
+		}
+
+		client.WriteValue(NewMap(map[string]*Value{
+			"flags":     stringValues(u.flags()),
+			"passwords": stringValues(u.passwords()),
+			"commands":  NewString(strings.Join(u.commandRules(), " ")),
+			"keys":      stringValues(u.keyRules()),
+		}))
+	case "deluser":
+		count := 0
+		for _, arg := range args {
+			name := arg.ToString()
+			if name == s.DefaultUser {
+				client.WriteError(fmt.Sprintf("The '%s' user cannot be removed", name))
+				return
+			}
+
+			if s.DeleteUser(name) {
+				count += 1
+			}
+		}
+
+		client.WriteValue(NewInt(count))
+	case "list":
+		client.WriteValue(stringValues(s.aclList()))
+	case "users":
+		client.WriteValue(stringValues(s.userNames()))
+	case "whoami":
+		name := s.DefaultUser
+		if client.User != nil {
+			name = client.User.Name
+		}
+
+		client.WriteValue(NewString(name))
+	case "cat":
+		if len(args) == 0 {
+			client.WriteValue(stringValues(s.aclCategories()))
+			return
+		}
+
+		category := strings.ToLower(args[0].ToString())
+		for _, c := range s.aclCategories() {
+			if c == category {
+				client.WriteValue(stringValues(s.aclCategoryCommands(category)))
+				return
+			}
+		}
+
+		client.WriteError(fmt.Sprintf("Unknown category '%s'", category))
+	case "save", "load":
+		if s.ACLFile == "" {
+			client.WriteError("This instance is not configured to use an ACL file")
+			return
+		}
+
+		var err error
+		if sub == "save" {
+			err = s.SaveACL(s.ACLFile)
+		} else {
+			err = s.LoadACL(s.ACLFile)
+		}
+
+		if err != nil {
+			client.WriteError(err.Error())
+			return
+		}
+
+		client.WriteOK()
+	default:
+		client.WriteError(fmt.Sprintf("unknown subcommand '%s'", sub))
+	}
+}
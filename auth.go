@@ -0,0 +1,264 @@
+package worm
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AuthFailureChannel receives a message each time authentication fails
+const AuthFailureChannel = "__worm__:authfail"
+
+// maxBcryptCost is the highest bcrypt cost accepted, each failed AUTH with a higher cost
+// would use a large amount of CPU time
+const maxBcryptCost = 14
+
+const errWrongPass = "WRONGPASS invalid username-password pair or user is disabled."
+
+// noAuthCommands can be run before authenticating, they also don't require permissions
+// so restricted users can always authenticate again or reset the connection
+var noAuthCommands = map[string]bool{
+	"hello": true,
+	"auth":  true,
+	"ping":  true,
+	"quit":  true,
+	"reset": true,
+}
+
+// HashPassword returns the hex encoded SHA-256 hash of a password, the same format used
+// by Redis ACL rules like "#<hash>"
+func HashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// HashPasswordBcrypt returns a salted bcrypt hash of a password, which can be used in
+// User.Passwords or in ACL rules like "#<hash>". A cost of 0 uses bcrypt.DefaultCost
+func HashPasswordBcrypt(password string, cost int) (string, error) {
+	if cost > maxBcryptCost {
+		return "", fmt.Errorf("bcrypt cost must be at most %d", maxBcryptCost)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// isBcryptHash returns true for bcrypt hashes with a cost that's allowed
+func isBcryptHash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err == nil && cost <= maxBcryptCost
+}
+
+// validPasswordHash returns true for hashes created by HashPassword or HashPasswordBcrypt
+func validPasswordHash(hash string) bool {
+	if isBcryptHash(hash) {
+		return true
+	}
+
+	if len(hash) != sha256.Size*2 || strings.ToLower(hash) != hash {
+		return false
+	}
+
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// verifyPassword compares a password against a hash in constant time, sum is the
+// SHA-256 hash of the password
+func verifyPassword(hash, password string, sum [sha256.Size]byte) bool {
+	if isBcryptHash(hash) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	expected, err := hex.DecodeString(hash)
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(expected, sum[:]) == 1
+}
+
+// authenticated returns true if a client is allowed to run commands, authentication is
+// only required when there are users
+func (s *Server) authenticated(client *Client) bool {
+	if client.User != nil {
+		return true
+	}
+
+	s.usersLock.RLock()
+	defer s.usersLock.RUnlock()
+
+	return len(s.Users) == 0
+}
+
+// defaultUser returns the user new connections are authenticated as, if any
+func (s *Server) defaultUser() *User {
+	s.usersLock.RLock()
+	defer s.usersLock.RUnlock()
+
+	// Without any users every connection is authenticated as the default user
+	if len(s.Users) == 0 && s.DefaultUser != "" {
+		return &User{Name: s.DefaultUser}
+	}
+
+	u, ok := s.Users[s.DefaultUser]
+	if !ok || u.Disabled || !u.NoPass {
+		return nil
+	}
+
+	return &User{Name: u.Name}
+}
+
+// maxAuthSources is the number of host and user pairs failures are tracked for
+const maxAuthSources = 65536
+
+// maxAuthBackoff is the longest delay when MaxAuthBackoff isn't set, doubling stops
+// before the delay overflows
+const maxAuthBackoff = time.Duration(1<<63 - 1)
+
+// authSource identifies where failed authentication attempts come from
+type authSource struct {
+	host string
+	user string
+}
+
+// remoteAddr returns the address of the client, or an empty string if it isn't connected
+func remoteAddr(client *Client) string {
+	if client.conn == nil || client.conn.RemoteAddr() == nil {
+		return ""
+	}
+
+	return client.conn.RemoteAddr().String()
+}
+
+// remoteHost returns the address of the client without the port, so reconnecting
+// doesn't reset the backoff
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return addr
+}
+
+// authenticate checks a user's credentials, failures are counted and reported using
+// AuthFailureHandler and AuthFailureChannel before the reply is delayed by AuthBackoff
+func (s *Server) authenticate(client *Client, user *User) bool {
+	name := ""
+	if user != nil {
+		name = user.Name
+	}
+
+	addr := remoteAddr(client)
+
+	// Failures for unknown users are counted together so the map can't grow unbounded
+	source := authSource{host: remoteHost(addr), user: name}
+	if _, ok := s.GetUser(name); !ok {
+		source.user = ""
+	}
+
+	if s.CheckUser(user) {
+		// Only the failures of the host that authenticated are reset
+		s.authLock.Lock()
+		delete(s.authFailures, source)
+		s.authLock.Unlock()
+		return true
+	}
+
+	s.authLock.Lock()
+	if _, ok := s.authFailures[source]; !ok && len(s.authFailures) >= maxAuthSources {
+		// Forget an arbitrary source to make room
+		for k := range s.authFailures {
+			delete(s.authFailures, k)
+			break
+		}
+	}
+	s.authFailures[source] += 1
+	s.authFailureCount += 1
+	n := s.authFailures[source]
+	s.authLock.Unlock()
+
+	if s.AuthFailureHandler != nil {
+		s.AuthFailureHandler(client, name)
+	}
+
+	s.Publish(AuthFailureChannel, NewMap(map[string]*Value{
+		"user": NewString(name),
+		"addr": NewString(addr),
+	}))
+
+	s.authDelay(client, n)
+	return false
+}
+
+// authDelay waits before replying to the nth consecutive failed authentication attempt
+func (s *Server) authDelay(client *Client, n int) {
+	delay := s.authBackoff(n)
+	if delay <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-client.Context().Done():
+	}
+}
+
+// authBackoff returns the delay for the nth consecutive failed authentication attempt,
+// AuthBackoff doubled for each previous failure up to MaxAuthBackoff
+func (s *Server) authBackoff(n int) time.Duration {
+	if s.AuthBackoff <= 0 {
+		return 0
+	}
+
+	delay := s.AuthBackoff
+	for i := 1; i < n && delay <= maxAuthBackoff/2; i++ {
+		if s.MaxAuthBackoff > 0 && delay >= s.MaxAuthBackoff {
+			break
+		}
+		delay *= 2
+	}
+
+	if s.MaxAuthBackoff > 0 && delay > s.MaxAuthBackoff {
+		delay = s.MaxAuthBackoff
+	}
+
+	return delay
+}
+
+// AuthFailures returns the number of consecutive failed authentication attempts for
+// a user from every host, failures for unknown users are counted using an empty name
+func (s *Server) AuthFailures(name string) int {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+
+	n := 0
+	for source, count := range s.authFailures {
+		if source.user == name {
+			n += count
+		}
+	}
+
+	return n
+}
+
+// AuthFailureCount returns the total number of failed authentication attempts
+func (s *Server) AuthFailureCount() uint64 {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+
+	return s.authFailureCount
+}
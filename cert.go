@@ -11,7 +11,9 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"math/big"
+	"net"
 	"os"
 	"time"
 )
@@ -43,7 +45,10 @@ func pemBlockForKey(priv interface{}) *pem.Block {
 	}
 }
 
-func GenerateSelfSignedSSLCert(prefix string) (*tls.Config, error) {
+// GenerateSelfSignedSSLCert writes a self-signed certificate and key to prefix.crt and
+// prefix.key, valid for hosts or localhost if no hosts are given. The certificate can be
+// used as a root CA by clients, see NewClientTLSConfig
+func GenerateSelfSignedSSLCert(prefix string, hosts ...string) (*tls.Config, error) {
 	priv, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
 	if err != nil {
 		return nil, err
@@ -56,26 +61,23 @@ func GenerateSelfSignedSSLCert(prefix string) (*tls.Config, error) {
 		},
 		NotBefore:             time.Now(),
 		NotAfter:              time.Now().Add(time.Hour * 24 * 180),
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
+		IsCA:                  true,
 	}
 
-	/*
-	   hosts := strings.Split(*host, ",")
-	   for _, h := range hosts {
-	   	if ip := net.ParseIP(h); ip != nil {
-	   		template.IPAddresses = append(template.IPAddresses, ip)
-	   	} else {
-	   		template.DNSNames = append(template.DNSNames, h)
-	   	}
-	   }
-
-	   if *isCA {
-	   	template.IsCA = true
-	   	template.KeyUsage |= x509.KeyUsageCertSign
-	   }
-	*/
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+	}
+
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
 
 	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, publicKey(priv), priv)
 	if err != nil {
@@ -107,3 +109,43 @@ func GenerateSelfSignedSSLCert(prefix string) (*tls.Config, error) {
 
 	return LoadX509KeyPair(prefix+".crt", prefix+".key")
 }
+
+// LoadCertPool loads PEM encoded certificates from caFile
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return pool, nil
+}
+
+// NewClientTLSConfig creates a client TLS config trusting the root CAs in caFile, the
+// system roots are used if caFile is empty. A client certificate is sent if certFile
+// and keyFile are set
+func NewClientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		kp, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{kp}
+	}
+
+	return config, nil
+}
@@ -2,6 +2,8 @@ package worm
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -10,12 +12,15 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
 	ErrInvalidType        = errors.New("invalid type")
 	ErrNotEnoughArguments = errors.New("not enough arguments")
 	ErrInvalidArguments   = errors.New("invalid arguments")
+	ErrInvalidStreamChunk = errors.New("invalid streamed string chunk")
 )
 
 type Client struct {
@@ -25,9 +30,64 @@ type Client struct {
 	Output  *bufio.Writer
 	User    *User
 	Data    map[string]interface{}
+
+	// Name is the client name set using HELLO SETNAME
+	Name string
+
+	// ServerInfo contains the server's reply to HELLO
+	ServerInfo map[string]*Value
+
+	// ReadTimeout and WriteTimeout limit how long reading a reply or sending commands
+	// can take, 0 means no limit
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// Limits restricts the size of messages that can be read
+	Limits Limits
+
+	// counter tracks the number of bytes read, depth and requestStart are the nesting
+	// depth and starting offset of the message being read
+	counter      *countingReader
+	depth        int
+	requestStart int64
+
+	// attributes holds key/value pairs to be sent before the next reply
+	attributes []*Value
+
+	// stateLock guards busy and closing, which are used to shut down server connections
+	// without interrupting a command
+	stateLock sync.Mutex
+	busy      bool
+	closing   bool
+
+	// ctx is cancelled when the connection is closed, commandCtx is only valid while a
+	// command is running
+	ctx        context.Context
+	cancel     context.CancelFunc
+	commandCtx context.Context
+
+	// writeLock is held while writing replies so published messages aren't interleaved,
+	// writing is set once the write deadline of the current reply has been set
+	writeLock sync.Mutex
+	writing   bool
+	channels  map[string]struct{}
+	patterns  map[string]struct{}
+	pushes    chan *Message
+
+	// Transaction state, dirty is guarded by the server's watch lock
+	multi      bool
+	multiError bool
+	inExec     bool
+	queue      []queuedCommand
+	watching   map[string]struct{}
+	dirty      bool
 }
 
 func (c *Client) Close() error {
+	if c.cancel != nil {
+		c.cancel()
+	}
+
 	if c.conn == nil {
 		return nil
 	}
@@ -35,6 +95,111 @@ func (c *Client) Close() error {
 	return c.conn.Close()
 }
 
+// Context returns the context of the command currently being run, it is cancelled when
+// the connection is closed, the server is closed or the server's CommandTimeout elapses
+func (c *Client) Context() context.Context {
+	if c.commandCtx != nil {
+		return c.commandCtx
+	}
+
+	if c.ctx != nil {
+		return c.ctx
+	}
+
+	return context.Background()
+}
+
+// watchDisconnect cancels the client's context if the connection is closed while a
+// command is running, nothing else reads from the connection until the returned function
+// is called to stop watching
+func (c *Client) watchDisconnect() func() {
+	// Pipelined commands are already buffered, the client can't be waiting for a reply
+	if c.conn == nil || c.cancel == nil || c.Input.Buffered() > 0 {
+		return func() {}
+	}
+
+	c.conn.SetReadDeadline(time.Time{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		_, err := c.Input.Peek(1)
+		if err == nil {
+			return
+		}
+
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return
+		}
+
+		c.cancel()
+	}()
+
+	return func() {
+		c.conn.SetReadDeadline(time.Now())
+		<-done
+		c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func (c *Client) beginCommand() bool {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	if c.closing {
+		return false
+	}
+
+	c.busy = true
+	return true
+}
+
+func (c *Client) endCommand() bool {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	c.busy = false
+
+	if c.closing {
+		c.writeShutdownNotice()
+		return false
+	}
+
+	return true
+}
+
+// shutdown closes the connection if it's idle, otherwise it will be closed once the
+// current command is finished
+func (c *Client) shutdown() {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	c.closing = true
+
+	if !c.busy {
+		c.writeShutdownNotice()
+		c.Close()
+	}
+}
+
+func (c *Client) writeShutdownNotice() {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.conn != nil {
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	}
+
+	if c.Version == "2" {
+		c.WriteError("server is shutting down")
+	} else {
+		c.Write(&Message{Kind: Push, Type: "shutdown", Value: NewArray([]*Value{})})
+	}
+
+	c.Output.Flush()
+}
+
 func (c *Client) readCRLF() error {
 	_, err := c.Input.ReadByte()
 	if err != nil {
@@ -50,17 +215,35 @@ func (c *Client) readCRLF() error {
 }
 
 func (c *Client) readLine() (string, error) {
-	s, err := c.Input.ReadString('\r')
-	if err != nil {
+	line := []byte{}
+
+	for {
+		b, err := c.Input.ReadSlice('\r')
+		line = append(line, b...)
+
+		if err == bufio.ErrBufferFull {
+			// Long lines are checked as they're read so they can't exceed the limits
+			if err = c.checkLineLength(len(line)); err != nil {
+				return "", err
+			}
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		break
+	}
+
+	if err := c.checkLineLength(len(line) - 1); err != nil {
 		return "", err
 	}
 
-	_, err = c.Input.ReadByte()
+	_, err := c.Input.ReadByte()
 	if err != nil {
 		return "", err
 	}
 
-	return s[:len(s)-1], nil
+	return string(line[:len(line)-1]), nil
 }
 
 func (c *Client) readLineInt() (int, error) {
@@ -78,9 +261,16 @@ func (c *Client) readBulkString() (*Value, error) {
 		return &NilValue, err
 	}
 
-	buf := make([]byte, length)
+	// RESP2 null bulk string
+	if length == -1 {
+		return NewNil(), nil
+	}
+
+	if err = c.checkBulkLength(length, length); err != nil {
+		return &NilValue, err
+	}
 
-	_, err = io.ReadFull(c.Input, buf)
+	buf, err := c.readBulkData(length)
 	if err != nil {
 		return &NilValue, err
 	}
@@ -88,30 +278,179 @@ func (c *Client) readBulkString() (*Value, error) {
 	return NewString(string(buf)), c.readCRLF()
 }
 
+// readBulkData reads n bytes of string data, the buffer grows as data arrives so a client
+// can't allocate memory by sending a length without the data
+func (c *Client) readBulkData(n int) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	if _, err := io.CopyN(buf, c.Input, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// readStreamMarker consumes the "?\r\n" following a type byte if the value uses
+// the streamed encoding
+func (c *Client) readStreamMarker() (bool, error) {
+	b, err := c.Input.Peek(1)
+	if err != nil {
+		return false, err
+	}
+
+	if b[0] != '?' {
+		return false, nil
+	}
+
+	if _, err = c.Input.Discard(1); err != nil {
+		return false, err
+	}
+
+	return true, c.readCRLF()
+}
+
+// readStreamEnd consumes the ".\r\n" end marker of a streamed aggregate if it is next
+func (c *Client) readStreamEnd() (bool, error) {
+	b, err := c.Input.Peek(1)
+	if err != nil {
+		return false, err
+	}
+
+	if b[0] != '.' {
+		return false, nil
+	}
+
+	if _, err = c.Input.Discard(1); err != nil {
+		return false, err
+	}
+
+	return true, c.readCRLF()
+}
+
+func (c *Client) readStreamedString() (*Value, error) {
+	buf := []byte{}
+
+	for {
+		ch, err := c.Input.ReadByte()
+		if err != nil {
+			return &NilValue, err
+		}
+
+		if ch != ';' {
+			return &NilValue, ErrInvalidStreamChunk
+		}
+
+		length, err := c.readLineInt()
+		if err != nil {
+			return &NilValue, err
+		}
+
+		if length == 0 {
+			break
+		}
+
+		if err = c.checkBulkLength(length, len(buf)+length); err != nil {
+			return &NilValue, err
+		}
+
+		chunk, err := c.readBulkData(length)
+		if err != nil {
+			return &NilValue, err
+		}
+
+		if err = c.readCRLF(); err != nil {
+			return &NilValue, err
+		}
+
+		buf = append(buf, chunk...)
+	}
+
+	return NewString(string(buf)), nil
+}
+
 func (c *Client) readArray() (*Value, error) {
 	length, err := c.readLineInt()
 	if err != nil {
 		return &NilValue, err
 	}
 
-	array := make([]*Value, length)
+	// RESP2 null array
+	if length == -1 {
+		return NewNil(), nil
+	}
+
+	if err = c.checkAggregateLength(length); err != nil {
+		return &NilValue, err
+	}
+
+	array := make([]*Value, 0, prealloc(length))
 
 	for i := 0; i < length; i++ {
-		array[i], err = c.ReadValue()
+		v, err := c.ReadValue()
 		if err != nil {
 			return &NilValue, err
 		}
+
+		array = append(array, v)
 	}
 	return NewArray(array), nil
 }
 
+func (c *Client) readStreamedArray() (*Value, error) {
+	array := []*Value{}
+
+	for {
+		end, err := c.readStreamEnd()
+		if err != nil {
+			return &NilValue, err
+		}
+
+		if end {
+			break
+		}
+
+		if err = c.checkAggregateLength(len(array) + 1); err != nil {
+			return &NilValue, err
+		}
+
+		v, err := c.ReadValue()
+		if err != nil {
+			return &NilValue, err
+		}
+
+		array = append(array, v)
+	}
+
+	return NewArray(array), nil
+}
+
+func (c *Client) readAggregate() (*Value, error) {
+	streamed, err := c.readStreamMarker()
+	if err != nil {
+		return &NilValue, err
+	}
+
+	if streamed {
+		return c.readStreamedArray()
+	}
+
+	return c.readArray()
+}
+
 func (c *Client) readMap() (*Value, error) {
 	length, err := c.readLineInt()
 	if err != nil {
 		return &NilValue, err
 	}
 
-	dest := make(map[string]*Value, length)
+	if err = c.checkAggregateLength(length); err != nil {
+		return &NilValue, err
+	}
+
+	dest := make([]MapEntry, 0, prealloc(length))
 
 	for i := 0; i < length; i++ {
 		k, err := c.ReadValue()
@@ -123,18 +462,66 @@ func (c *Client) readMap() (*Value, error) {
 			return &NilValue, err
 		}
 
-		if !k.Is(String) {
-			continue
+		dest = append(dest, MapEntry{Key: k, Value: v})
+	}
+
+	return NewMapEntries(dest), nil
+}
+
+func (c *Client) readStreamedMap() (*Value, error) {
+	dest := []MapEntry{}
+
+	for {
+		end, err := c.readStreamEnd()
+		if err != nil {
+			return &NilValue, err
+		}
+
+		if end {
+			break
+		}
+
+		if err = c.checkAggregateLength(len(dest) + 1); err != nil {
+			return &NilValue, err
 		}
 
-		dest[k.ToString()] = v
+		k, err := c.ReadValue()
+		if err != nil {
+			return &NilValue, err
+		}
+		v, err := c.ReadValue()
+		if err != nil {
+			return &NilValue, err
+		}
+
+		dest = append(dest, MapEntry{Key: k, Value: v})
 	}
 
-	return NewMap(dest), nil
+	return NewMapEntries(dest), nil
 }
 
 func (c *Client) Read() (*Message, error) {
+	if c.depth == 0 && c.counter != nil {
+		c.requestStart = c.consumed()
+	}
+
+	c.depth += 1
+	defer func() {
+		c.depth -= 1
+	}()
+
+	if c.Limits.MaxDepth > 0 && c.depth > c.Limits.MaxDepth {
+		return nil, ErrNestingDepth
+	}
+
+	if err := c.checkRequestSize(0); err != nil {
+		return nil, err
+	}
+
 	ch, err := c.Input.ReadByte()
+	if err != nil {
+		return nil, err
+	}
 
 	message := &Message{Kind: Default}
 	switch ch {
@@ -145,21 +532,16 @@ func (c *Client) Read() (*Message, error) {
 		}
 		message.Value = &NilValue
 	case '$':
-		r, _, err := c.Input.ReadRune()
+		streamed, err := c.readStreamMarker()
 		if err != nil {
 			return nil, err
 		}
 
-		// Streaming
-		if r == '?' {
-			return nil, errors.New("Streaming strings are not implemented")
-		}
-
-		if err := c.Input.UnreadRune(); err != nil {
-			return nil, err
+		if streamed {
+			message.Value, err = c.readStreamedString()
+		} else {
+			message.Value, err = c.readBulkString()
 		}
-
-		message.Value, err = c.readBulkString()
 		if err != nil {
 			return nil, err
 		}
@@ -169,9 +551,16 @@ func (c *Client) Read() (*Message, error) {
 			return nil, err
 		}
 
-		buf := make([]byte, length)
+		// Verbatim strings start with a 3 byte format and a colon
+		if length < 4 {
+			return nil, ErrBulkLength
+		}
 
-		_, err = io.ReadFull(c.Input, buf)
+		if err = c.checkBulkLength(length, length); err != nil {
+			return nil, err
+		}
+
+		buf, err := c.readBulkData(length)
 		if err != nil {
 			return nil, err
 		}
@@ -183,8 +572,7 @@ func (c *Client) Read() (*Message, error) {
 
 		message.Kind = Verbatim
 		message.Type = string(buf[:3])
-		message.Value.Kind = Bytes
-		message.Value.Data = buf[4:]
+		message.Value = NewBytes(buf[4:])
 	case '+':
 		s, err := c.readLine()
 		if err != nil {
@@ -196,13 +584,18 @@ func (c *Client) Read() (*Message, error) {
 		if err != nil {
 			return nil, err
 		}
+
+		// Only RESP2 strings can be null
+		if message.Value.IsNil() {
+			return nil, ErrBulkLength
+		}
 		message.Value.Kind = Error
 	case '-':
 		s, err := c.readLine()
 		if err != nil {
 			return nil, err
 		}
-		message.Value = NewError(s)
+		message.Value = NewErrorNoPrefix(s)
 	case ':':
 		s, err := c.readLine()
 		if err != nil {
@@ -249,44 +642,65 @@ func (c *Client) Read() (*Message, error) {
 		}
 		message.Value = NewBool(v)
 	case '*':
-		r, _, err := c.Input.ReadRune()
-		if err != nil {
-			return nil, err
-		}
-		// Streaming
-		if r == '?' {
-			return nil, errors.New("Streaming strings are not implemented")
-		}
-
-		if err := c.Input.UnreadRune(); err != nil {
-			return nil, err
-		}
-
-		message.Value, err = c.readArray()
+		message.Value, err = c.readAggregate()
 		if err != nil {
 			return nil, err
 		}
 	case '~':
-		message.Value, err = c.readArray()
+		message.Value, err = c.readAggregate()
 		if err != nil {
 			return nil, err
 		}
-		message.Kind = SetReply
+
+		// Only RESP2 arrays can be null
+		if message.Value.IsNil() {
+			return nil, ErrAggregateLength
+		}
+		message.Value.Kind = Set
 	case '>':
 		message.Value, err = c.readArray()
 		if err != nil {
 			return nil, err
 		}
 
+		if message.Value.IsNil() {
+			return nil, ErrAggregateLength
+		}
+
 		arr := message.Value.ToArray()
+		if len(arr) == 0 {
+			return nil, ErrInvalidType
+		}
+
 		message.Type = arr[0].ToString()
 		message.Value = NewArray(arr[1:])
 		message.Kind = Push
 	case '%':
-		message.Value, err = c.readMap()
+		streamed, err := c.readStreamMarker()
 		if err != nil {
 			return nil, err
 		}
+
+		if streamed {
+			message.Value, err = c.readStreamedMap()
+		} else {
+			message.Value, err = c.readMap()
+		}
+		if err != nil {
+			return nil, err
+		}
+	case '|':
+		attrs, err := c.readMap()
+		if err != nil {
+			return nil, err
+		}
+
+		// Attributes are followed by the reply they describe
+		message, err = c.Read()
+		if err != nil {
+			return nil, err
+		}
+		message.Attributes = attrs
 	case 'p':
 		fallthrough
 	case 'P':
@@ -332,12 +746,53 @@ func (c *Client) WriteCRLF() error {
 	return err
 }
 
+// SetAttribute attaches an attribute to the next reply, attributes are dropped when
+// the client is using RESP2
+func (c *Client) SetAttribute(key, value *Value) {
+	c.attributes = append(c.attributes, key, value)
+}
+
+func (c *Client) writeAttributes() error {
+	attrs := c.attributes
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	// Attributes are cleared before writing so nested values don't write them again
+	c.attributes = nil
+
+	if c.Version == "2" {
+		return nil
+	}
+
+	_, err := c.Output.WriteString(fmt.Sprint("|", len(attrs)/2, "\r\n"))
+	if err != nil {
+		return err
+	}
+
+	for _, v := range attrs {
+		if err = c.WriteValue(v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (c *Client) WriteArrayHeader(n int) error {
+	if err := c.writeAttributes(); err != nil {
+		return err
+	}
+
 	_, err := c.Output.Write([]byte(fmt.Sprintf("*%d\r\n", n)))
 	return err
 }
 
 func (c *Client) WriteMapHeader(n int) error {
+	if err := c.writeAttributes(); err != nil {
+		return err
+	}
+
 	_, err := c.Output.Write([]byte(fmt.Sprintf("%%%d\r\n", n)))
 	return err
 }
@@ -347,43 +802,33 @@ func (c *Client) Write(message *Message) error {
 		return nil
 	}
 
+	if message.Attributes != nil {
+		c.attributes = append(c.attributes, message.Attributes.ToArray()...)
+	}
+
+	if err := c.writeAttributes(); err != nil {
+		return err
+	}
+
+	// HELLO is written the same way in both protocol versions
+	if message.Kind == Hello {
+		return c.writeHello(message)
+	}
+
 	if c.Version == "2" {
+		// Push messages are written as arrays starting with the message type
+		if message.Kind == Push {
+			return c.writeValueV2(NewArray(append([]*Value{NewString(message.Type)}, message.Value.ToArray()...)))
+		}
+
 		return c.writeValueV2(message.Value)
 	}
 
 	switch message.Kind {
 	case Default:
 		c.WriteValue(message.Value)
-	case Hello:
-		if message.User != nil {
-			c.WriteArrayHeader(5)
-		} else {
-			c.WriteArrayHeader(2)
-		}
-
-		c.WriteValue(NewString("HELLO"))
-		c.WriteValue(NewString("3"))
-
-		if message.User != nil {
-			c.WriteValue(NewString("AUTH"))
-			c.WriteValue(NewString(message.User.Name))
-			return c.WriteValue(NewString(message.User.Password))
-		}
-
-		return nil
 	case SetReply:
-		a := message.Value.ToArray()
-		_, err := c.Output.WriteString(fmt.Sprint("~", len(a), "\r\n"))
-		if err != nil {
-			return err
-		}
-
-		for _, v := range a {
-			err = c.WriteValue(v)
-			if err != nil {
-				return err
-			}
-		}
+		return c.WriteValue(NewSet(message.Value.ToArray()))
 	case Push:
 		a := message.Value.ToArray()
 		_, err := c.Output.WriteString(fmt.Sprint(">", len(a)+1, "\r\n"))
@@ -450,7 +895,7 @@ func (c *Client) writeValueV2(val *Value) error {
 			return err
 		}
 		err = c.WriteCRLF()
-	case Array:
+	case Array, Set:
 		a := val.ToArray()
 		err := c.WriteArrayHeader(len(a))
 		if err != nil {
@@ -464,19 +909,19 @@ func (c *Client) writeValueV2(val *Value) error {
 			}
 		}
 	case Map:
-		a := val.ToMap()
+		a := val.ToMapEntries()
 		err := c.WriteArrayHeader(len(a) * 2)
 		if err != nil {
 			return err
 		}
 
-		for k, v := range a {
-			err = c.writeValueV2(New(k))
+		for _, e := range a {
+			err = c.writeValueV2(e.Key)
 			if err != nil {
 				return err
 			}
 
-			err = c.writeValueV2(v)
+			err = c.writeValueV2(e.Value)
 			if err != nil {
 				return err
 			}
@@ -489,6 +934,10 @@ func (c *Client) writeValueV2(val *Value) error {
 func (c *Client) WriteValue(val *Value) error {
 	var err error
 
+	if err = c.writeAttributes(); err != nil {
+		return err
+	}
+
 	if c.Version == "2" {
 		return c.writeValueV2(val)
 	}
@@ -559,6 +1008,19 @@ func (c *Client) WriteValue(val *Value) error {
 			return err
 		}
 
+		for _, v := range a {
+			err = c.WriteValue(v)
+			if err != nil {
+				return err
+			}
+		}
+	case Set:
+		a := val.ToArray()
+		_, err := c.Output.WriteString(fmt.Sprint("~", len(a), "\r\n"))
+		if err != nil {
+			return err
+		}
+
 		for _, v := range a {
 			err = c.WriteValue(v)
 			if err != nil {
@@ -566,19 +1028,19 @@ func (c *Client) WriteValue(val *Value) error {
 			}
 		}
 	case Map:
-		d := val.ToMap()
+		d := val.ToMapEntries()
 		err := c.WriteMapHeader(len(d))
 		if err != nil {
 			return err
 		}
 
-		for k, v := range d {
-			err = c.WriteValue(NewString(k))
+		for _, e := range d {
+			err = c.WriteValue(e.Key)
 			if err != nil {
 				return err
 			}
 
-			err = c.WriteValue(v)
+			err = c.WriteValue(e.Value)
 			if err != nil {
 				return err
 			}
@@ -589,6 +1051,10 @@ func (c *Client) WriteValue(val *Value) error {
 }
 
 func (c *Client) WriteStringHeader(n int) error {
+	if err := c.writeAttributes(); err != nil {
+		return err
+	}
+
 	_, err := c.Output.WriteString(fmt.Sprint("$", n, "\r\n"))
 	return err
 }
@@ -598,11 +1064,19 @@ func (c *Client) WriteBytesHeader(n int, tag string) error {
 		return errors.New("Invalid verbatim string tag")
 	}
 
+	if err := c.writeAttributes(); err != nil {
+		return err
+	}
+
 	_, err := c.Output.WriteString(fmt.Sprint("=", n, "\r\n", tag, ":"))
 	return err
 }
 
 func (c *Client) WriteSimpleString(s string) error {
+	if err := c.writeAttributes(); err != nil {
+		return err
+	}
+
 	_, err := c.Output.WriteString(fmt.Sprint("+", s, "\r\n"))
 	return err
 }
@@ -615,33 +1089,81 @@ func (c *Client) WriteError(msg string) error {
 	return c.WriteValue(NewError(msg))
 }
 
-func (c *Client) Command(args ...string) (*Message, error) {
+func (c *Client) writeCommand(args ...string) error {
 	length := len(args)
-	c.WriteArrayHeader(length)
+	if err := c.WriteArrayHeader(length); err != nil {
+		return err
+	}
+
 	for i := 0; i < length; i++ {
 		if err := c.WriteValue(NewString(args[i])); err != nil {
-			return nil, err
+			return err
 		}
 	}
 
+	return nil
+}
+
+// deadlineWriter sets the write deadline when a reply starts being sent, WriteTimeout
+// limits sending the whole reply even once it no longer fits in the output buffer
+type deadlineWriter struct {
+	client *Client
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	c := w.client
+	if c.WriteTimeout > 0 && !c.writing {
+		c.conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+		c.writing = true
+	}
+
+	return c.conn.Write(p)
+}
+
+// flush sends buffered output and ends the current reply, releasing its write deadline
+func (c *Client) flush() error {
+	err := c.Output.Flush()
+
+	if c.writing {
+		c.conn.SetWriteDeadline(time.Time{})
+		c.writing = false
+	}
+
+	return err
+}
+
+// readReply reads a single reply, using ReadTimeout as the deadline
+func (c *Client) readReply() (*Message, error) {
+	if c.ReadTimeout > 0 && c.conn != nil {
+		c.conn.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+		defer c.conn.SetReadDeadline(time.Time{})
+	}
+
 	return c.Read()
 }
 
-func (c *Client) Exec(args ...*Value) (*Message, error) {
-	if err := c.WriteValue(NewArray(args)); err != nil {
+func (c *Client) Command(args ...string) (*Message, error) {
+	if err := c.writeCommand(args...); err != nil {
 		return nil, err
 	}
 
-	return c.Read()
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+
+	return c.readReply()
 }
 
-func ConnectVersion(addr string, version string) (*Client, error) {
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
+func (c *Client) Exec(args ...*Value) (*Message, error) {
+	if err := c.WriteValue(NewArray(args)); err != nil {
+		return nil, err
+	}
+
+	if err := c.flush(); err != nil {
 		return nil, err
 	}
 
-	return NewClientVersion(conn, version), nil
+	return c.readReply()
 }
 
 func NewClient(conn net.Conn) *Client {
@@ -649,23 +1171,16 @@ func NewClient(conn net.Conn) *Client {
 }
 
 func NewClientVersion(conn net.Conn, version string) *Client {
-	r := bufio.NewReader(conn)
-	w := bufio.NewWriter(conn)
+	counter := &countingReader{r: conn}
+	r := bufio.NewReader(counter)
 
 	client := &Client{
 		Input:   r,
-		Output:  w,
 		conn:    conn,
+		counter: counter,
 		Data:    map[string]interface{}{},
 		Version: version,
 	}
+	client.Output = bufio.NewWriter(deadlineWriter{client})
 	return client
 }
-
-func Connect(addr string) (*Client, error) {
-	return ConnectVersion(addr, "3")
-}
-
-func ConnectV2(addr string) (*Client, error) {
-	return ConnectVersion(addr, "2")
-}
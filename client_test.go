@@ -3,8 +3,17 @@ package worm
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 type example struct {
@@ -49,3 +58,560 @@ func TestProtocolRoundtrip(t *testing.T) {
 		t.Fatal("Invalid rountrip value:", a, x)
 	}
 }
+
+func newTestClient() *Client {
+	buf := &bytes.Buffer{}
+
+	return &Client{
+		Output: bufio.NewWriter(buf),
+		Input:  bufio.NewReader(buf),
+	}
+}
+
+func TestStreamedString(t *testing.T) {
+	client := newTestClient()
+
+	w, err := client.StreamString()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"hello", "", " ", "world"} {
+		if _, err := w.WriteString(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	client.Output.Flush()
+
+	x, err := client.ReadValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if x.ToString() != "hello world" {
+		t.Fatal("Invalid streamed string:", x)
+	}
+}
+
+func TestStreamedAggregate(t *testing.T) {
+	client := newTestClient()
+
+	w, err := client.StreamArray()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Write(NewInt(1), NewString("two")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Write(NewInt(3)); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := client.StreamMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Write(NewString("a"), NewInt(4)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	client.Output.Flush()
+
+	x, err := client.ReadValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := NewArray([]*Value{
+		NewInt(1),
+		NewString("two"),
+		NewInt(3),
+		NewMap(map[string]*Value{"a": NewInt(4)}),
+	})
+
+	if !reflect.DeepEqual(expected, x) {
+		t.Fatal("Invalid streamed aggregate:", x)
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	client := newTestClient()
+
+	client.SetAttribute(NewString("popularity"), NewFloat64(0.5))
+
+	if err := client.WriteValue(NewArray([]*Value{NewString("a")})); err != nil {
+		t.Fatal(err)
+	}
+	client.Output.Flush()
+
+	msg, err := client.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(msg.Value, NewArray([]*Value{NewString("a")})) {
+		t.Fatal("Invalid value:", msg.Value)
+	}
+
+	if msg.Attributes == nil || msg.Attributes.ToMap()["popularity"].ToFloat64() != 0.5 {
+		t.Fatal("Invalid attributes:", msg.Attributes)
+	}
+}
+
+func TestMapKeys(t *testing.T) {
+	client := newTestClient()
+
+	a := NewMapEntries([]MapEntry{
+		{Key: NewInt(2), Value: NewString("b")},
+		{Key: NewArray([]*Value{NewString("x")}), Value: NewBool(true)},
+		{Key: NewString("a"), Value: NewInt(1)},
+	})
+
+	if err := client.WriteValue(a); err != nil {
+		t.Fatal(err)
+	}
+	client.Output.Flush()
+
+	x, err := client.ReadValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(a, x) {
+		t.Fatal("Invalid map:", x)
+	}
+}
+
+func TestErrorReply(t *testing.T) {
+	client := newTestClient()
+
+	client.Output.WriteString("-ERR invalid command\r\n")
+	client.Output.Flush()
+
+	msg, err := client.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The error is read as sent, without adding another prefix
+	if msg.Value.ToError() == nil || msg.Value.ToError().Error() != "ERR invalid command" {
+		t.Fatal("Invalid error reply:", msg.Value)
+	}
+}
+
+func TestNullReplies(t *testing.T) {
+	client := newTestClient()
+
+	client.Output.WriteString("$-1\r\n*-1\r\n")
+	client.Output.Flush()
+
+	for i := 0; i < 2; i++ {
+		msg, err := client.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !msg.Value.IsNil() {
+			t.Fatal("Expected nil reply:", msg.Value)
+		}
+	}
+}
+
+func TestVerbatimString(t *testing.T) {
+	client := newTestClient()
+
+	client.Output.WriteString("=15\r\ntxt:Some string\r\n")
+	client.Output.Flush()
+
+	msg, err := client.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Kind != Verbatim || msg.Type != "txt" || string(msg.Value.ToBytes()) != "Some string" {
+		t.Fatal("Invalid verbatim string:", msg.Type, msg.Value)
+	}
+}
+
+func TestSet(t *testing.T) {
+	client := newTestClient()
+
+	a := NewMap(map[string]*Value{
+		"members": NewSet([]*Value{NewString("a"), NewString("b")}),
+	})
+
+	if err := client.WriteValue(a); err != nil {
+		t.Fatal(err)
+	}
+	client.Output.Flush()
+
+	x, err := client.ReadValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(a, x) {
+		t.Fatal("Invalid set:", x)
+	}
+
+	client.Version = "2"
+	if err := client.WriteValue(a); err != nil {
+		t.Fatal(err)
+	}
+	client.Output.Flush()
+
+	x, err = client.ReadValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !x.ToArray()[1].Is(Array) {
+		t.Fatal("Expected set to be written as an array in RESP2 mode:", x)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	server, _ := newTestServer(t, &testContext{})
+	defer server.Close()
+
+	client, err := ConnectV2(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	p := client.Pipeline()
+	p.Command("add", "2", "a")
+	p.Command("add", "x")
+	p.Exec(NewString("ping"), NewString("hello"))
+
+	replies, err := p.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(replies) != 3 {
+		t.Fatal("Invalid reply count:", len(replies))
+	}
+
+	if replies[0].Value.ToInt() != 2 || replies[1].Err() == nil || replies[2].Value.ToString() != "hello" {
+		t.Fatal("Invalid replies:", replies[0].Value, replies[1].Value, replies[2].Value)
+	}
+}
+
+func TestPool(t *testing.T) {
+	server, _ := newTestServer(t, &testContext{})
+	defer server.Close()
+
+	pool := NewPool(server.Addr)
+	pool.MaxActive = 1
+	defer pool.Close()
+
+	client, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pool.Get(); err != ErrPoolExhausted {
+		t.Fatal("Expected ErrPoolExhausted:", err)
+	}
+
+	if msg, err := client.Command("ping"); err != nil || msg.Value.ToString() != "PONG" {
+		t.Fatal("Invalid reply:", msg, err)
+	}
+
+	pool.Put(client)
+
+	again, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again != client {
+		t.Fatal("Expected idle connection to be reused")
+	}
+
+	stats := pool.Stats()
+	if stats.InUse != 1 || stats.Hits != 1 || stats.Misses != 1 || stats.Exhausted != 1 {
+		t.Fatal("Invalid stats:", stats)
+	}
+
+	pool.Discard(again)
+
+	// Returning a connection twice doesn't release another slot
+	pool.Put(again)
+	pool.Discard(again)
+
+	client, err = pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pool.Get(); err != ErrPoolExhausted {
+		t.Fatal("Expected ErrPoolExhausted:", err)
+	}
+
+	if stats := pool.Stats(); stats.InUse != 1 || stats.Idle != 0 {
+		t.Fatal("Invalid stats:", stats)
+	}
+
+	pool.Put(client)
+}
+
+func TestPoolCloseWaiting(t *testing.T) {
+	server, _ := newTestServer(t, &testContext{})
+	defer server.Close()
+
+	pool := NewPool(server.Addr)
+	pool.MaxActive = 1
+	pool.Wait = true
+
+	client, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		c, err := pool.Get()
+		if c != nil {
+			c.Close()
+		}
+		errs <- err
+	}()
+
+	// Closing the pool wakes up waiting calls to Get
+	time.Sleep(time.Millisecond * 10)
+	pool.Close()
+
+	select {
+	case err := <-errs:
+		if err != ErrPoolClosed {
+			t.Fatal("Expected ErrPoolClosed:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Get is still waiting after Close")
+	}
+
+	pool.Put(client)
+
+	if _, err := pool.Get(); err != ErrPoolClosed {
+		t.Fatal("Expected ErrPoolClosed:", err)
+	}
+}
+
+func TestHello(t *testing.T) {
+	server, _ := newTestServer(t, &testContext{})
+	defer server.Close()
+
+	server.SetUser(User{Name: "bob", Password: "secret"})
+
+	client, err := ConnectWithOptions(server.Addr, ConnectOptions{
+		Username:   "bob",
+		Password:   "secret",
+		ClientName: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if client.Version != "3" || client.ServerInfo["proto"].ToInt() != 3 {
+		t.Fatal("Expected RESP3 connection:", client.Version, client.ServerInfo)
+	}
+
+	if _, err := ConnectWithOptions(server.Addr, ConnectOptions{Username: "bob", Password: "wrong"}); err == nil {
+		t.Fatal("Expected authentication error")
+	}
+}
+
+func TestConnectTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "worm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	prefix := filepath.Join(dir, "worm")
+	serverConfig, err := GenerateSelfSignedSSLCert(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The self-signed certificate is also used as the client certificate
+	serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	serverConfig.ClientCAs, err = LoadCertPool(prefix + ".crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewTCPServer("127.0.0.1:0", serverConfig, &testContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Run()
+
+	config, err := NewClientTLSConfig(prefix+".crt", prefix+".crt", prefix+".key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := ConnectTLS(server.Addr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if msg, err := client.Command("ping"); err != nil || msg.Value.ToString() != "PONG" {
+		t.Fatal("Invalid reply:", msg, err)
+	}
+
+	if _, err := ConnectTLS(server.Addr, &tls.Config{RootCAs: config.RootCAs}); err == nil {
+		t.Fatal("Expected error without client certificate")
+	}
+}
+
+func TestConnectUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "worm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("unix", filepath.Join(dir, "worm.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(l, &testContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Run()
+
+	client, err := ConnectUnix(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.ReadTimeout = time.Second
+	client.WriteTimeout = time.Second
+
+	if msg, err := client.Command("ping"); err != nil || msg.Value.ToString() != "PONG" {
+		t.Fatal("Invalid reply:", msg, err)
+	}
+
+	// Timeouts are reported to the caller instead of io.EOF
+	client.ReadTimeout = time.Millisecond * 10
+
+	_, err = client.Command("wait")
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatal("Expected timeout error:", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	limits := Limits{
+		MaxBulkLength:      8,
+		MaxAggregateLength: 2,
+		MaxDepth:           2,
+		MaxRequestSize:     30,
+	}
+
+	tests := []struct {
+		input string
+		err   error
+	}{
+		{"$9999999999\r\n", ErrBulkLength},
+		{"$-5\r\n", ErrBulkLength},
+		{"$?\r\n;4\r\nabcd\r\n;5\r\nefghi\r\n;0\r\n", ErrBulkLength},
+		{"*3\r\n:1\r\n:2\r\n:3\r\n", ErrAggregateLength},
+		{"%-2\r\n", ErrAggregateLength},
+		{"%-1\r\n", ErrAggregateLength},
+		{"~-1\r\n", ErrAggregateLength},
+		{">-1\r\n", ErrAggregateLength},
+		{"!-1\r\n", ErrBulkLength},
+		{"=3\r\ntxt\r\n", ErrBulkLength},
+		{"=9\r\ntxt:hello\r\n", ErrBulkLength},
+		{"*?\r\n:1\r\n:2\r\n:3\r\n.\r\n", ErrAggregateLength},
+		{"*1\r\n*1\r\n*1\r\n:1\r\n", ErrNestingDepth},
+		{"+" + strings.Repeat("a", 8192) + "\r\n", ErrRequestSize},
+		{"*2\r\n$8\r\naaaaaaaa\r\n$8\r\naaaaaaaa\r\n", ErrRequestSize},
+	}
+
+	for _, test := range tests {
+		counter := &countingReader{r: strings.NewReader(test.input)}
+		client := &Client{
+			Input:   bufio.NewReader(counter),
+			counter: counter,
+			Limits:  limits,
+		}
+
+		if _, err := client.Read(); err != test.err {
+			t.Fatalf("Expected %v for %q: %v", test.err, test.input, err)
+		}
+	}
+
+	// Lines are limited separately from strings
+	for _, input := range []string{"+" + strings.Repeat("a", 8192) + "\r\n", "$" + strings.Repeat("1", 32) + "\r\n", ":123\r\n"} {
+		client := &Client{
+			Input:  bufio.NewReader(strings.NewReader(input)),
+			Limits: Limits{MaxLineLength: 16},
+		}
+
+		expected := ErrLineLength
+		if len(input) < 16 {
+			expected = nil
+		}
+
+		if _, err := client.Read(); err != expected {
+			t.Fatalf("Expected %v for %q: %v", expected, input, err)
+		}
+	}
+
+	// Strings are only allocated as their data arrives
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	client := &Client{Input: bufio.NewReader(strings.NewReader("$1073741824\r\nabc"))}
+	if _, err := client.Read(); err != io.ErrUnexpectedEOF {
+		t.Fatal("Expected io.ErrUnexpectedEOF:", err)
+	}
+
+	runtime.ReadMemStats(&after)
+	if after.TotalAlloc-before.TotalAlloc > 1024*1024 {
+		t.Fatal("Too much memory allocated:", after.TotalAlloc-before.TotalAlloc)
+	}
+
+	// Each message has its own request size
+	input := strings.Repeat("*2\r\n$4\r\naaaa\r\n$4\r\naaaa\r\n", 3)
+	counter := &countingReader{r: strings.NewReader(input)}
+	client = &Client{
+		Input:   bufio.NewReader(counter),
+		counter: counter,
+		Limits:  limits,
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.Read(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
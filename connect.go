@@ -0,0 +1,193 @@
+package worm
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+)
+
+// ConnectOptions configures the handshake performed when connecting to a server
+type ConnectOptions struct {
+	// Version is the protocol version, "3" or "2", defaults to "3"
+	Version string
+
+	// Username and Password are sent using HELLO AUTH, Username defaults to "default"
+	// when only a password is provided
+	Username string
+	Password string
+
+	// ClientName is sent using HELLO SETNAME
+	ClientName string
+
+	// Network is either "tcp" or "unix", defaults to "tcp"
+	Network string
+
+	// TLSConfig enables TLS when set
+	TLSConfig *tls.Config
+
+	// DialTimeout limits how long connecting to the server can take
+	DialTimeout time.Duration
+
+	// ReadTimeout and WriteTimeout limit how long reading a reply or sending commands
+	// can take, 0 means no limit
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+func (c *Client) writeHello(message *Message) error {
+	version := message.Type
+	if version == "" {
+		version = "3"
+	}
+
+	args := []string{"HELLO", version}
+
+	if message.User != nil {
+		args = append(args, "AUTH", message.User.Name, message.User.Password)
+	}
+
+	if message.Value != nil && !message.Value.IsNil() {
+		args = append(args, "SETNAME", message.Value.ToString())
+	}
+
+	return c.writeCommand(args...)
+}
+
+// Hello performs the HELLO handshake, switching the client to the requested protocol
+// version. Servers that don't support HELLO or RESP3 fall back to RESP2 using AUTH
+func (c *Client) Hello(opts ConnectOptions) error {
+	version := opts.Version
+	if version == "" {
+		version = "3"
+	}
+
+	var user *User
+	if opts.Username != "" || opts.Password != "" {
+		user = &User{Name: opts.Username, Password: opts.Password}
+		if user.Name == "" {
+			user.Name = "default"
+		}
+	}
+
+	// RESP2 is the default, so there's nothing to negotiate
+	if version == "2" && user == nil && opts.ClientName == "" {
+		c.Version = version
+		return nil
+	}
+
+	msg := &Message{Kind: Hello, Type: version, User: user}
+	if opts.ClientName != "" {
+		msg.Value = NewString(opts.ClientName)
+	}
+
+	if err := c.Write(msg); err != nil {
+		return err
+	}
+
+	if err := c.flush(); err != nil {
+		return err
+	}
+
+	// The reply is sent using the requested protocol version
+	prev := c.Version
+	c.Version = version
+
+	reply, err := c.readReply()
+	if err != nil {
+		return err
+	}
+
+	if err := reply.Err(); err != nil {
+		c.Version = prev
+
+		s := err.Error()
+		if !strings.HasPrefix(s, "NOPROTO") && !strings.HasPrefix(s, "ERR unknown command") && !strings.HasPrefix(s, "ERR invalid command") {
+			return err
+		}
+
+		return c.fallbackAuth(user)
+	}
+
+	c.Name = opts.ClientName
+	c.User = user
+	c.ServerInfo = reply.Value.ToMap()
+	return nil
+}
+
+// fallbackAuth authenticates with servers that don't support HELLO
+func (c *Client) fallbackAuth(user *User) error {
+	c.Version = "2"
+
+	if user == nil {
+		return nil
+	}
+
+	reply, err := c.Command("AUTH", user.Name, user.Password)
+	if err != nil {
+		return err
+	}
+
+	if err := reply.Err(); err != nil {
+		return err
+	}
+
+	c.User = user
+	return nil
+}
+
+func dial(addr string, opts ConnectOptions) (net.Conn, error) {
+	network := opts.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	dialer := &net.Dialer{Timeout: opts.DialTimeout}
+
+	if opts.TLSConfig != nil {
+		return tls.DialWithDialer(dialer, network, addr, opts.TLSConfig)
+	}
+
+	return dialer.Dial(network, addr)
+}
+
+func ConnectWithOptions(addr string, opts ConnectOptions) (*Client, error) {
+	conn, err := dial(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	client := NewClientVersion(conn, "2")
+	client.ReadTimeout = opts.ReadTimeout
+	client.WriteTimeout = opts.WriteTimeout
+
+	if err := client.Hello(opts); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+func ConnectVersion(addr string, version string) (*Client, error) {
+	return ConnectWithOptions(addr, ConnectOptions{Version: version})
+}
+
+func Connect(addr string) (*Client, error) {
+	return ConnectVersion(addr, "3")
+}
+
+func ConnectV2(addr string) (*Client, error) {
+	return ConnectVersion(addr, "2")
+}
+
+// ConnectTLS connects to a TLS server, see NewClientTLSConfig to configure root CAs
+// and client certificates
+func ConnectTLS(addr string, config *tls.Config) (*Client, error) {
+	return ConnectWithOptions(addr, ConnectOptions{TLSConfig: config})
+}
+
+// ConnectUnix connects to a server listening on a unix socket
+func ConnectUnix(path string) (*Client, error) {
+	return ConnectWithOptions(path, ConnectOptions{Network: "unix"})
+}
@@ -0,0 +1,98 @@
+package worm
+
+// globMatch matches s against a Redis-style glob pattern supporting `*`, `?`, character
+// classes like `[a-z]` or `[^abc]` and `\` to escape special characters
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+
+	// Position in the pattern after the last `*` and the position in s it's retrying from,
+	// when a match fails the star is extended by one character instead of recursing
+	star, next := -1, 0
+
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+
+			if p == len(pattern) {
+				return true
+			}
+
+			star, next = p, i
+			continue
+		}
+
+		if p < len(pattern) {
+			if n, ok := globMatchOne(pattern[p:], s[i]); ok {
+				p += n
+				i++
+				continue
+			}
+		}
+
+		if star < 0 {
+			return false
+		}
+
+		next++
+		p, i = star, next
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
+
+// globMatchOne matches a single character against the start of the pattern, returning the
+// length of the pattern that was matched
+func globMatchOne(pattern string, c byte) (int, bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		end := 1
+		negate := end < len(pattern) && pattern[end] == '^'
+		if negate {
+			end++
+		}
+
+		match := false
+		for end < len(pattern) && pattern[end] != ']' {
+			if pattern[end] == '\\' && end+1 < len(pattern) {
+				end++
+				if pattern[end] == c {
+					match = true
+				}
+			} else if end+2 < len(pattern) && pattern[end+1] == '-' && pattern[end+2] != ']' {
+				lo, hi := pattern[end], pattern[end+2]
+				if lo > hi {
+					lo, hi = hi, lo
+				}
+
+				if c >= lo && c <= hi {
+					match = true
+				}
+				end += 2
+			} else if pattern[end] == c {
+				match = true
+			}
+			end++
+		}
+
+		// An unterminated class ends the pattern
+		if end >= len(pattern) {
+			return len(pattern), match != negate
+		}
+
+		return end + 1, match != negate
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, pattern[1] == c
+		}
+	}
+
+	return 1, pattern[0] == c
+}
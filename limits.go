@@ -0,0 +1,129 @@
+package worm
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	ErrBulkLength      = errors.New("Protocol error: invalid bulk length")
+	ErrAggregateLength = errors.New("Protocol error: invalid multibulk length")
+	ErrNestingDepth    = errors.New("Protocol error: nesting too deep")
+	ErrRequestSize     = errors.New("Protocol error: request too large")
+	ErrLineLength      = errors.New("Protocol error: line too long")
+)
+
+// maxPrealloc is the largest number of aggregate elements allocated before they're read,
+// larger aggregates grow as elements arrive
+const maxPrealloc = 1024
+
+// Limits restricts the size of messages accepted by Client.Read, 0 means no limit
+type Limits struct {
+	// MaxBulkLength is the maximum length of a single string
+	MaxBulkLength int
+
+	// MaxAggregateLength is the maximum number of elements in an array, set or map
+	MaxAggregateLength int
+
+	// MaxDepth is the maximum nesting depth of aggregates
+	MaxDepth int
+
+	// MaxRequestSize is the maximum number of bytes in a single message
+	MaxRequestSize int
+
+	// MaxLineLength is the maximum length of simple strings, numbers and length headers
+	MaxLineLength int
+}
+
+// DefaultLimits are the limits used for server connections unless Server.Limits is changed,
+// they match the defaults of Redis: strings up to 512MB (proto-max-bulk-len), aggregates
+// with up to 1M elements, 64 levels of nesting, requests up to 1GB
+// (client-query-buffer-limit) and lines up to 64KB. Memory is only allocated for data a
+// client has actually sent, so the memory used reading a command grows with
+// MaxRequestSize, lower it or set Server.MaxClients when connections aren't trusted
+var DefaultLimits = Limits{
+	MaxBulkLength:      512 * 1024 * 1024,
+	MaxAggregateLength: 1024 * 1024,
+	MaxDepth:           64,
+	MaxRequestSize:     1024 * 1024 * 1024,
+	MaxLineLength:      64 * 1024,
+}
+
+// isProtocolError returns true when err is caused by a message exceeding the client's
+// limits, the connection can't be used after reading such a message
+func isProtocolError(err error) bool {
+	switch err {
+	case ErrBulkLength, ErrAggregateLength, ErrNestingDepth, ErrRequestSize, ErrLineLength:
+		return true
+	}
+
+	return false
+}
+
+// countingReader counts the bytes read from a connection so the size of a message can
+// be determined while it's being read
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// consumed returns the number of bytes read from Input so far
+func (c *Client) consumed() int64 {
+	return c.counter.n - int64(c.Input.Buffered())
+}
+
+// checkRequestSize checks that reading n more bytes won't exceed MaxRequestSize
+func (c *Client) checkRequestSize(n int) error {
+	if c.Limits.MaxRequestSize <= 0 || c.counter == nil {
+		return nil
+	}
+
+	if c.consumed()-c.requestStart+int64(n) > int64(c.Limits.MaxRequestSize) {
+		return ErrRequestSize
+	}
+
+	return nil
+}
+
+// checkBulkLength checks a string of length n followed by CRLF, total is the length of
+// the whole string when it's streamed in chunks
+func (c *Client) checkBulkLength(n, total int) error {
+	if n < 0 || (c.Limits.MaxBulkLength > 0 && total > c.Limits.MaxBulkLength) {
+		return ErrBulkLength
+	}
+
+	return c.checkRequestSize(n + 2)
+}
+
+// checkLineLength checks a line of length n, long lines are also checked while they're
+// being read
+func (c *Client) checkLineLength(n int) error {
+	if c.Limits.MaxLineLength > 0 && n > c.Limits.MaxLineLength {
+		return ErrLineLength
+	}
+
+	return c.checkRequestSize(0)
+}
+
+func (c *Client) checkAggregateLength(n int) error {
+	if n < 0 || (c.Limits.MaxAggregateLength > 0 && n > c.Limits.MaxAggregateLength) {
+		return ErrAggregateLength
+	}
+
+	return nil
+}
+
+// prealloc returns the initial capacity used for an aggregate with n elements
+func prealloc(n int) int {
+	if n > maxPrealloc {
+		return maxPrealloc
+	}
+
+	return n
+}
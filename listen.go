@@ -0,0 +1,197 @@
+package worm
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenFDsStart is the first file descriptor passed using socket activation
+const listenFDsStart = 3
+
+var ErrNoListenFDs = errors.New("no listeners passed using LISTEN_FDS")
+
+// ListenFDs returns the listeners passed to the process using systemd-style socket
+// activation. The LISTEN_* environment variables are unset so they aren't inherited
+// by child processes
+func ListenFDs() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, ErrNoListenFDs
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, ErrNoListenFDs
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := []net.Listener{}
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(listenFDsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		// FileListener duplicates the descriptor, so the original is closed
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("invalid listener %s: %s", name, err)
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// NewListenFDsServer creates a server accepting connections from all listeners passed
+// using LISTEN_FDS, see ListenFDs
+func NewListenFDsServer(tlsConfig *tls.Config, ctx interface{}) (*Server, error) {
+	listeners, err := ListenFDs()
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig != nil {
+		for i, l := range listeners {
+			listeners[i] = tls.NewListener(l, tlsConfig)
+		}
+	}
+
+	if len(listeners) == 1 {
+		return NewServer(listeners[0], ctx)
+	}
+
+	return NewServer(newMultiListener(listeners), ctx)
+}
+
+// NewUnixServer creates a server listening on a unix socket with the given file
+// permissions. A socket left behind by a server that is no longer running is removed
+func NewUnixServer(path string, perm os.FileMode, ctx interface{}) (*Server, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, perm); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return NewServer(l, ctx)
+}
+
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+
+	return os.Remove(path)
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// multiListener accepts connections from several listeners at once
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	done      chan struct{}
+	once      sync.Once
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	m := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan acceptResult),
+		done:      make(chan struct{}),
+	}
+
+	for _, l := range listeners {
+		go m.accept(l)
+	}
+
+	return m
+}
+
+func (m *multiListener) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+
+		select {
+		case m.accepted <- acceptResult{conn, err}:
+		case <-m.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-m.accepted:
+		return r.conn, r.err
+	case <-m.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (m *multiListener) Close() error {
+	var err error
+
+	m.once.Do(func() {
+		close(m.done)
+		for _, l := range m.listeners {
+			if e := l.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+
+	return err
+}
+
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
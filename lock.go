@@ -0,0 +1,151 @@
+package worm
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// LockPolicy determines how commands are synchronized when accessing the server context
+type LockPolicy int
+
+const (
+	// GlobalLock runs a single command at a time
+	GlobalLock LockPolicy = iota
+
+	// NoLock runs commands concurrently, the context is responsible for its own synchronization
+	NoLock
+
+	// ReadWriteLock runs commands marked as ReadOnly concurrently, all other commands
+	// are run one at a time
+	ReadWriteLock
+
+	// KeyLock only locks the keys declared in a command's CommandSpec, commands without
+	// any keys are run one at a time
+	KeyLock
+)
+
+const keyLockShards = 256
+
+// CommandSpec describes how a command accesses the server context, key positions are
+// 1-based indices into the command arguments like the Redis COMMAND reply
+type CommandSpec struct {
+	ReadOnly bool
+
+	// FirstKey is the position of the first key argument, or 0 if the command has no keys
+	FirstKey int
+
+	// LastKey is the position of the last key argument, negative values count from the
+	// last argument and 0 means the command only has a single key
+	LastKey int
+
+	// KeyStep is the distance between key arguments, defaults to 1
+	KeyStep int
+
+	// Categories are the ACL categories the command belongs to, commands are always in
+	// either @read or @write depending on ReadOnly
+	Categories []string
+}
+
+// Keys returns the key arguments from args
+func (spec CommandSpec) Keys(args []*Value) []string {
+	if spec.FirstKey <= 0 {
+		return nil
+	}
+
+	last := spec.LastKey
+	if last < 0 {
+		last = len(args) + last + 1
+	} else if last == 0 {
+		last = spec.FirstKey
+	}
+
+	step := spec.KeyStep
+	if step <= 0 {
+		step = 1
+	}
+
+	keys := []string{}
+	for i := spec.FirstKey; i <= last && i <= len(args); i += step {
+		keys = append(keys, args[i-1].ToString())
+	}
+
+	return keys
+}
+
+type keyLocks [keyLockShards]sync.RWMutex
+
+func keyShards(keys []string) []int {
+	seen := map[int]bool{}
+	shards := []int{}
+
+	for _, k := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(k))
+		i := int(h.Sum32() % keyLockShards)
+		if !seen[i] {
+			seen[i] = true
+			shards = append(shards, i)
+		}
+	}
+
+	// Shards are always locked in the same order to avoid deadlocks
+	sort.Ints(shards)
+	return shards
+}
+
+// lockCommand acquires the locks required to run a command using the server's LockPolicy,
+// the returned function releases them
+func (s *Server) lockCommand(name string, args []*Value) func() {
+	spec := s.Specs[name]
+
+	switch s.LockPolicy {
+	case NoLock:
+		return func() {}
+	case ReadWriteLock:
+		if spec.ReadOnly {
+			s.contextLock.RLock()
+			return s.contextLock.RUnlock
+		}
+	case KeyLock:
+		keys := spec.Keys(args)
+		if len(keys) == 0 {
+			break
+		}
+
+		shards := keyShards(keys)
+
+		s.contextLock.RLock()
+		for _, i := range shards {
+			if spec.ReadOnly {
+				s.keyLocks[i].RLock()
+			} else {
+				s.keyLocks[i].Lock()
+			}
+		}
+
+		return func() {
+			for j := len(shards) - 1; j >= 0; j-- {
+				if spec.ReadOnly {
+					s.keyLocks[shards[j]].RUnlock()
+				} else {
+					s.keyLocks[shards[j]].Unlock()
+				}
+			}
+			s.contextLock.RUnlock()
+		}
+	}
+
+	s.contextLock.Lock()
+	return s.contextLock.Unlock
+}
+
+// lockAll acquires the locks required to run a transaction, excluding all other commands
+func (s *Server) lockAll() func() {
+	if s.LockPolicy == NoLock {
+		return func() {}
+	}
+
+	s.contextLock.Lock()
+	return s.contextLock.Unlock
+}
@@ -2,13 +2,14 @@ package worm
 
 type MessageKind int
 
-// TODO: streaming types + Hello
-
 const (
 	Default MessageKind = iota
 	Verbatim
+	// SetReply writes the message value as a set, new code should use a Set value instead
 	SetReply
 	Push
+	// Hello writes a HELLO command, Type is the protocol version (defaults to "3"), User
+	// contains the AUTH credentials and Value the SETNAME client name, both are optional
 	Hello
 )
 
@@ -17,4 +18,16 @@ type Message struct {
 	Type  string
 	Value *Value
 	User  *User
+
+	// Attributes is a map of out-of-band data sent along with the reply, or nil
+	Attributes *Value
+}
+
+// Err returns the error contained in an error reply, or nil
+func (m *Message) Err() error {
+	if m.Value == nil {
+		return nil
+	}
+
+	return m.Value.ToError()
 }
@@ -0,0 +1,197 @@
+package worm
+
+import (
+	"bufio"
+	"bytes"
+)
+
+type queuedCommand struct {
+	name string
+	args []*Value
+}
+
+// transactionCommands are run immediately when a client is in a transaction
+var transactionCommands = map[string]bool{
+	"multi":   true,
+	"exec":    true,
+	"discard": true,
+	"watch":   true,
+	"unwatch": true,
+	"quit":    true,
+	"reset":   true,
+}
+
+// noTransactionCommands can't be queued, AUTH and HELLO could otherwise block every other
+// client while a failed attempt is delayed during EXEC
+var noTransactionCommands = map[string]bool{
+	"auth":  true,
+	"hello": true,
+}
+
+func (s *Server) handleMulti(client *Client) {
+	if client.multi {
+		client.WriteError("MULTI calls can not be nested")
+		return
+	}
+
+	client.multi = true
+	client.WriteOK()
+}
+
+func (s *Server) queueCommand(client *Client, cmd string, args []*Value) {
+	if _, ok := s.Commands[cmd]; !ok && !isBuiltinCommand(cmd) {
+		client.multiError = true
+		client.WriteValue(NewError("invalid command"))
+		return
+	}
+
+	if noTransactionCommands[cmd] {
+		client.multiError = true
+		client.WriteError("Command not allowed inside a transaction")
+		return
+	}
+
+	client.queue = append(client.queue, queuedCommand{name: cmd, args: args})
+	client.WriteSimpleString("QUEUED")
+}
+
+func (c *Client) resetTransaction() {
+	c.multi = false
+	c.multiError = false
+	c.queue = nil
+}
+
+func (s *Server) handleDiscard(client *Client) {
+	if !client.multi {
+		client.WriteError("DISCARD without MULTI")
+		return
+	}
+
+	client.resetTransaction()
+	s.unwatch(client)
+	client.WriteOK()
+}
+
+func (s *Server) handleExec(client *Client) {
+	if !client.multi {
+		client.WriteError("EXEC without MULTI")
+		return
+	}
+
+	queue, failed := client.queue, client.multiError
+	client.resetTransaction()
+
+	if failed {
+		s.unwatch(client)
+		client.WriteValue(NewErrorNoPrefix("EXECABORT Transaction discarded because of previous errors."))
+		return
+	}
+
+	unlock := s.lockAll()
+	defer unlock()
+
+	s.watchLock.Lock()
+	dirty := client.dirty
+	s.watchLock.Unlock()
+	s.unwatch(client)
+
+	// Aborted transactions reply with a null array, RESP3 only has a single null type
+	if dirty {
+		if client.Version == "2" {
+			client.WriteArrayHeader(-1)
+		} else {
+			client.WriteValue(NewNil())
+		}
+		return
+	}
+
+	client.inExec = true
+	defer func() {
+		client.inExec = false
+	}()
+
+	client.WriteArrayHeader(len(queue))
+
+	// Each reply is buffered so errors only discard the output of a single command
+	output := client.Output
+	buf := &bytes.Buffer{}
+	for _, q := range queue {
+		buf.Reset()
+		client.Output = bufio.NewWriter(buf)
+
+		_, err := s.dispatch(client, q.name, q.args)
+		if err != nil {
+			buf.Reset()
+			client.Output.Reset(buf)
+			client.attributes = nil
+			client.WriteValue(NewError(err.Error()))
+		}
+
+		client.Output.Flush()
+		client.Output = output
+		output.Write(buf.Bytes())
+	}
+}
+
+func (s *Server) handleWatch(client *Client, args []*Value) {
+	if client.multi {
+		client.WriteError("WATCH inside MULTI is not allowed")
+		return
+	}
+
+	if len(args) == 0 {
+		client.WriteError("wrong number of arguments for 'watch' command")
+		return
+	}
+
+	s.watchLock.Lock()
+	defer s.watchLock.Unlock()
+
+	if client.watching == nil {
+		client.watching = map[string]struct{}{}
+	}
+
+	for _, arg := range args {
+		k := arg.ToString()
+
+		if s.watched[k] == nil {
+			s.watched[k] = map[*Client]struct{}{}
+		}
+		s.watched[k][client] = struct{}{}
+		client.watching[k] = struct{}{}
+	}
+
+	client.WriteOK()
+}
+
+func (s *Server) unwatch(client *Client) {
+	s.watchLock.Lock()
+	defer s.watchLock.Unlock()
+
+	for k := range client.watching {
+		delete(s.watched[k], client)
+		if len(s.watched[k]) == 0 {
+			delete(s.watched, k)
+		}
+	}
+
+	client.watching = nil
+	client.dirty = false
+}
+
+// Touch marks keys as modified, aborting the transactions of any clients watching them.
+// Keys declared in the CommandSpec of commands that aren't ReadOnly are touched automatically
+func (s *Server) Touch(keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	s.watchLock.Lock()
+	defer s.watchLock.Unlock()
+
+	for _, k := range keys {
+		for client := range s.watched[k] {
+			client.dirty = true
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package worm
+
+// Pipeline queues commands on a client and sends them all at once when Flush is called,
+// replies are returned in the same order as the commands were queued
+type Pipeline struct {
+	client *Client
+	count  int
+	err    error
+}
+
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{client: c}
+}
+
+func (p *Pipeline) Command(args ...string) {
+	if p.err != nil {
+		return
+	}
+
+	p.err = p.client.writeCommand(args...)
+	p.count += 1
+}
+
+func (p *Pipeline) Exec(args ...*Value) {
+	if p.err != nil {
+		return
+	}
+
+	p.err = p.client.WriteValue(NewArray(args))
+	p.count += 1
+}
+
+// Len returns the number of queued commands
+func (p *Pipeline) Len() int {
+	return p.count
+}
+
+// Flush sends all queued commands and reads their replies. Commands that failed on
+// the server return error replies, see Message.Err. If the connection fails the replies
+// that were read before the failure are returned along with the error
+func (p *Pipeline) Flush() ([]*Message, error) {
+	count, err := p.count, p.err
+	p.count = 0
+	p.err = nil
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.client.flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]*Message, 0, count)
+	for i := 0; i < count; i++ {
+		msg, err := p.client.readReply()
+		if err != nil {
+			return replies, err
+		}
+
+		replies = append(replies, msg)
+	}
+
+	return replies, nil
+}
@@ -0,0 +1,315 @@
+package worm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrPoolExhausted = errors.New("connection pool exhausted")
+	ErrPoolClosed    = errors.New("connection pool closed")
+)
+
+// Pool is a thread-safe pool of client connections. Connections are taken from the pool
+// using Get and must be returned using Put, or Discard if they are no longer usable
+type Pool struct {
+	// Dial creates new connections, any HELLO/AUTH setup should be performed here
+	// so it's shared by every connection in the pool
+	Dial func() (*Client, error)
+
+	// MaxIdle is the maximum number of idle connections kept in the pool
+	MaxIdle int
+
+	// MaxActive is the maximum number of connections in use at once, 0 means no limit
+	MaxActive int
+
+	// IdleTimeout closes connections that have been idle for longer than the timeout,
+	// 0 means connections are never closed for being idle
+	IdleTimeout time.Duration
+
+	// HealthCheck is the amount of time a connection can be idle before it's checked
+	// using PING, 0 disables health checks
+	HealthCheck time.Duration
+
+	// Wait makes Get wait for a connection to be returned when MaxActive connections
+	// are in use, otherwise ErrPoolExhausted is returned
+	Wait bool
+
+	mu     sync.Mutex
+	idle   []idleClient
+	active chan struct{}
+	inUse  int
+	out    map[*Client]struct{}
+	closed bool
+	done   chan struct{}
+	stats  PoolStats
+}
+
+type idleClient struct {
+	client *Client
+	since  time.Time
+}
+
+type PoolStats struct {
+	// InUse is the number of connections currently taken from the pool
+	InUse int
+
+	// Idle is the number of idle connections in the pool
+	Idle int
+
+	// Hits is the number of times an idle connection was reused
+	Hits uint64
+
+	// Misses is the number of times a new connection was created
+	Misses uint64
+
+	// Waits is the number of times Get had to wait for a connection
+	Waits uint64
+
+	// Exhausted is the number of times Get failed because the pool was exhausted
+	Exhausted uint64
+
+	// Closed is the number of idle connections closed because they timed out, failed
+	// a health check or exceeded MaxIdle
+	Closed uint64
+}
+
+func NewPool(addr string) *Pool {
+	return &Pool{
+		Dial: func() (*Client, error) {
+			return Connect(addr)
+		},
+		MaxIdle:     8,
+		HealthCheck: time.Minute,
+	}
+}
+
+func (p *Pool) Get() (*Client, error) {
+	return p.GetContext(context.Background())
+}
+
+// GetContext returns a connection from the pool, when Wait is enabled it waits until
+// a connection is available or ctx is done
+func (p *Pool) GetContext(ctx context.Context) (*Client, error) {
+	if err := p.acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	if client := p.popIdle(); client != nil {
+		p.mu.Lock()
+		p.stats.Hits += 1
+		p.checkOut(client)
+		p.mu.Unlock()
+		return client, nil
+	}
+
+	p.mu.Lock()
+	p.stats.Misses += 1
+	p.mu.Unlock()
+
+	client, err := p.Dial()
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.checkOut(client)
+	p.mu.Unlock()
+
+	return client, nil
+}
+
+// checkOut marks a connection as in use, p.mu must be held
+func (p *Pool) checkOut(client *Client) {
+	if p.out == nil {
+		p.out = map[*Client]struct{}{}
+	}
+	p.out[client] = struct{}{}
+}
+
+// checkIn marks a connection as returned, false is returned if the connection wasn't
+// taken from the pool or was already returned
+func (p *Pool) checkIn(client *Client) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.out[client]; !ok {
+		return false
+	}
+
+	delete(p.out, client)
+	return true
+}
+
+func (p *Pool) acquire(ctx context.Context) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrPoolClosed
+	}
+
+	if p.MaxActive > 0 && p.active == nil {
+		p.active = make(chan struct{}, p.MaxActive)
+	}
+	if p.done == nil {
+		p.done = make(chan struct{})
+	}
+	active, done := p.active, p.done
+	p.mu.Unlock()
+
+	if active != nil {
+		select {
+		case active <- struct{}{}:
+		default:
+			p.mu.Lock()
+			if !p.Wait {
+				p.stats.Exhausted += 1
+				p.mu.Unlock()
+				return ErrPoolExhausted
+			}
+			p.stats.Waits += 1
+			p.mu.Unlock()
+
+			select {
+			case active <- struct{}{}:
+			case <-done:
+				return ErrPoolClosed
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	// The pool may have been closed while waiting
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		if active != nil {
+			<-active
+		}
+		return ErrPoolClosed
+	}
+	p.inUse += 1
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *Pool) release() {
+	p.mu.Lock()
+	active := p.active
+	p.inUse -= 1
+	p.mu.Unlock()
+
+	if active != nil {
+		<-active
+	}
+}
+
+// popIdle returns the most recently used idle connection that is still usable
+func (p *Pool) popIdle() *Client {
+	for {
+		p.mu.Lock()
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+
+		ic := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		idle := time.Since(ic.since)
+
+		if p.IdleTimeout > 0 && idle > p.IdleTimeout {
+			p.closeIdle(ic.client)
+			continue
+		}
+
+		if p.HealthCheck > 0 && idle > p.HealthCheck {
+			msg, err := ic.client.Command("PING")
+			if err != nil || msg.Err() != nil {
+				p.closeIdle(ic.client)
+				continue
+			}
+		}
+
+		return ic.client
+	}
+}
+
+func (p *Pool) closeIdle(client *Client) {
+	client.Close()
+
+	p.mu.Lock()
+	p.stats.Closed += 1
+	p.mu.Unlock()
+}
+
+// Put returns a connection to the pool, connections with unread replies or unsent
+// commands are closed. Returning a connection that isn't in use has no effect
+func (p *Pool) Put(client *Client) {
+	if !p.checkIn(client) {
+		return
+	}
+	defer p.release()
+
+	if client.Input.Buffered() > 0 || client.Output.Buffered() > 0 {
+		client.Close()
+		return
+	}
+
+	p.mu.Lock()
+	if p.closed || len(p.idle) >= p.MaxIdle {
+		p.mu.Unlock()
+		p.closeIdle(client)
+		return
+	}
+
+	p.idle = append(p.idle, idleClient{client: client, since: time.Now()})
+	p.mu.Unlock()
+}
+
+// Discard closes a connection taken from the pool instead of returning it, discarding
+// a connection that isn't in use has no effect
+func (p *Pool) Discard(client *Client) {
+	if !p.checkIn(client) {
+		return
+	}
+	defer p.release()
+
+	client.Close()
+}
+
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.stats
+	stats.Idle = len(p.idle)
+	stats.InUse = p.inUse
+
+	return stats
+}
+
+// Close closes all idle connections, connections that are in use are closed when they
+// are returned to the pool
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	if !p.closed && p.done != nil {
+		// Wake up any calls to Get that are waiting for a connection
+		close(p.done)
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	for _, ic := range idle {
+		ic.client.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,267 @@
+package worm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// pushQueueSize is the number of messages that can be queued for a subscriber before
+// it's disconnected for being too slow
+const pushQueueSize = 1024
+
+type pubsub struct {
+	lock     sync.RWMutex
+	channels map[string]map[*Client]struct{}
+	patterns map[string]map[*Client]struct{}
+}
+
+func newPubsub() pubsub {
+	return pubsub{
+		channels: map[string]map[*Client]struct{}{},
+		patterns: map[string]map[*Client]struct{}{},
+	}
+}
+
+// subscriberCommands are the only commands allowed for RESP2 clients with subscriptions
+var subscriberCommands = map[string]bool{
+	"subscribe":    true,
+	"psubscribe":   true,
+	"unsubscribe":  true,
+	"punsubscribe": true,
+	"ping":         true,
+	"quit":         true,
+	"reset":        true,
+}
+
+func (c *Client) subscriptionCount() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+// deliver writes published messages to the client until the queue is closed
+func (c *Client) deliver(lock *sync.RWMutex) {
+	for msg := range c.pushes {
+		c.writeLock.Lock()
+
+		// Messages queued before the client unsubscribed are dropped
+		lock.RLock()
+		ok := c.subscribed(msg)
+		lock.RUnlock()
+
+		if ok {
+			c.Write(msg)
+			c.flush()
+		}
+		c.writeLock.Unlock()
+	}
+}
+
+// subscribed returns true if the client is still subscribed to the channel or pattern
+// a message was published to
+func (c *Client) subscribed(msg *Message) bool {
+	name := msg.Value.ToArray()[0].ToString()
+
+	if msg.Type == "pmessage" {
+		_, ok := c.patterns[name]
+		return ok
+	}
+
+	_, ok := c.channels[name]
+	return ok
+}
+
+// discardPushes drops any messages that haven't been delivered yet
+func (c *Client) discardPushes() {
+	for {
+		select {
+		case <-c.pushes:
+		default:
+			return
+		}
+	}
+}
+
+func (c *Client) push(msg *Message) {
+	select {
+	case c.pushes <- msg:
+	default:
+		// The client isn't reading messages fast enough
+		c.Close()
+	}
+}
+
+func (c *Client) writeSubscription(kind string, name *Value) error {
+	return c.Write(&Message{
+		Kind:  Push,
+		Type:  kind,
+		Value: NewArray([]*Value{name, NewInt(c.subscriptionCount())}),
+	})
+}
+
+func (s *Server) subscribe(client *Client, names []*Value, pattern bool) {
+	if len(names) == 0 {
+		cmd := "subscribe"
+		if pattern {
+			cmd = "psubscribe"
+		}
+
+		client.WriteError(fmt.Sprintf("wrong number of arguments for '%s' command", cmd))
+		return
+	}
+
+	s.pubsub.lock.Lock()
+	defer s.pubsub.lock.Unlock()
+
+	if client.pushes == nil {
+		client.channels = map[string]struct{}{}
+		client.patterns = map[string]struct{}{}
+		client.pushes = make(chan *Message, pushQueueSize)
+		go client.deliver(&s.pubsub.lock)
+	}
+
+	kind, subscribers, subscriptions := "subscribe", s.pubsub.channels, client.channels
+	if pattern {
+		kind, subscribers, subscriptions = "psubscribe", s.pubsub.patterns, client.patterns
+	}
+
+	for _, name := range names {
+		k := name.ToString()
+
+		if subscribers[k] == nil {
+			subscribers[k] = map[*Client]struct{}{}
+		}
+		subscribers[k][client] = struct{}{}
+		subscriptions[k] = struct{}{}
+
+		client.writeSubscription(kind, name)
+	}
+}
+
+func (s *Server) unsubscribe(client *Client, names []*Value, pattern bool) {
+	s.pubsub.lock.Lock()
+	defer s.pubsub.lock.Unlock()
+
+	kind, subscribers, subscriptions := "unsubscribe", s.pubsub.channels, client.channels
+	if pattern {
+		kind, subscribers, subscriptions = "punsubscribe", s.pubsub.patterns, client.patterns
+	}
+
+	// Without any arguments the client is unsubscribed from everything
+	if len(names) == 0 {
+		keys := make([]string, 0, len(subscriptions))
+		for k := range subscriptions {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			names = append(names, NewString(k))
+		}
+	}
+
+	if len(names) == 0 {
+		client.writeSubscription(kind, NewNil())
+		return
+	}
+
+	for _, name := range names {
+		k := name.ToString()
+
+		delete(subscriptions, k)
+		delete(subscribers[k], client)
+		if len(subscribers[k]) == 0 {
+			delete(subscribers, k)
+		}
+
+		client.writeSubscription(kind, name)
+	}
+
+	if client.subscriptionCount() == 0 {
+		client.discardPushes()
+	}
+}
+
+// removeSubscriber removes all subscriptions when a client disconnects
+func (s *Server) removeSubscriber(client *Client) {
+	s.pubsub.lock.Lock()
+	defer s.pubsub.lock.Unlock()
+
+	if client.pushes == nil {
+		return
+	}
+
+	for k := range client.channels {
+		delete(s.pubsub.channels[k], client)
+		if len(s.pubsub.channels[k]) == 0 {
+			delete(s.pubsub.channels, k)
+		}
+	}
+
+	for k := range client.patterns {
+		delete(s.pubsub.patterns[k], client)
+		if len(s.pubsub.patterns[k]) == 0 {
+			delete(s.pubsub.patterns, k)
+		}
+	}
+
+	client.channels = nil
+	client.patterns = nil
+	client.discardPushes()
+	close(client.pushes)
+	client.pushes = nil
+}
+
+// Publish sends a message to all clients subscribed to the channel, returning the
+// number of clients that received the message
+func (s *Server) Publish(channel string, message *Value) int {
+	s.pubsub.lock.RLock()
+	defer s.pubsub.lock.RUnlock()
+
+	count := 0
+	ch := NewString(channel)
+
+	for client := range s.pubsub.channels[channel] {
+		client.push(&Message{
+			Kind:  Push,
+			Type:  "message",
+			Value: NewArray([]*Value{ch, message}),
+		})
+		count += 1
+	}
+
+	for pattern, clients := range s.pubsub.patterns {
+		if !globMatch(pattern, channel) {
+			continue
+		}
+
+		for client := range clients {
+			client.push(&Message{
+				Kind:  Push,
+				Type:  "pmessage",
+				Value: NewArray([]*Value{NewString(pattern), ch, message}),
+			})
+			count += 1
+		}
+	}
+
+	return count
+}
+
+func (s *Server) handlePublish(client *Client, args []*Value) {
+	if len(args) != 2 {
+		client.WriteError("wrong number of arguments for 'publish' command")
+		return
+	}
+
+	client.WriteValue(NewInt(s.Publish(args[0].ToString(), args[1])))
+}
+
+func (s *Server) handleSubscriberMode(client *Client, cmd string) bool {
+	if client.Version != "2" || client.subscriptionCount() == 0 || subscriberCommands[cmd] {
+		return false
+	}
+
+	client.WriteError(fmt.Sprintf("Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", strings.ToLower(cmd)))
+	return true
+}
@@ -1,40 +1,59 @@
 package worm
 
 import (
-	"bufio"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"log"
 	"net"
 	"reflect"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"time"
 )
 
 const WormVersion = 1
 
+var ErrServerClosed = errors.New("server closed")
+
 type Command = func(*Client, []*Value) error
 
+// Middleware runs around every command, next calls the remaining middleware followed by
+// the command itself. Middleware can reject a command by returning an error without
+// calling next
+type Middleware func(cmd string, client *Client, args []*Value, next Command) error
+
 type User struct {
-	Name        string
-	Password    string
+	Name     string
+	Password string
+
+	// Passwords are hashes of additional passwords accepted for the user, see
+	// HashPassword and HashPasswordBcrypt
+	Passwords []string
+
+	// NoPass allows the user to authenticate using any password
+	NoPass bool
+
+	// Disabled users can't authenticate
+	Disabled bool
+
+	// Permissions is a list of allowed commands, an empty list allows all commands.
+	// It's only used when Commands is nil
 	Permissions []string
-}
 
-func (u *User) Can(perm string) bool {
-	if len(u.Permissions) == 0 {
-		return true
-	}
+	// Commands are ACL rules such as "+@read", "-@write" or "+set", the last matching
+	// rule determines if a command is allowed
+	Commands []string
 
-	for _, x := range u.Permissions {
-		x = strings.ToLower(x)
-		if perm == x {
-			return true
-		}
-	}
+	// Keys are glob patterns matching the keys the user can access, nil allows all keys
+	Keys []string
+}
 
-	return false
+func (u *User) Can(perm string) bool {
+	return u.can(perm, builtinCommands[perm])
 }
 
 type Server struct {
@@ -46,7 +65,69 @@ type Server struct {
 	s           net.Listener
 	Closed      bool
 	Users       map[string]User
-	contextLock sync.Mutex
+	usersLock   sync.RWMutex
+	LockPolicy  LockPolicy
+	Specs       map[string]CommandSpec
+	contextLock sync.RWMutex
+	keyLocks    keyLocks
+	mu          sync.Mutex
+	clients     map[*Client]struct{}
+	wg          sync.WaitGroup
+
+	// CommandTimeout limits how long the context passed to each command is valid for
+	CommandTimeout time.Duration
+	ctx            context.Context
+	cancel         context.CancelFunc
+
+	// IdleTimeout closes connections that haven't sent a command within the timeout,
+	// 0 means connections are never closed for being idle
+	IdleTimeout time.Duration
+
+	// WriteTimeout limits how long sending a reply to a client can take
+	WriteTimeout time.Duration
+
+	// MaxClients is the maximum number of connected clients, 0 means no limit
+	MaxClients int
+
+	// KeepAlive is the TCP keepalive period, 0 uses the system default and a negative
+	// value disables keepalives
+	KeepAlive time.Duration
+
+	// Limits restricts the size of commands sent by clients, see DefaultLimits
+	Limits Limits
+
+	// PanicHandler is called after a command panics, the returned error is sent to the
+	// client instead of the default error. cmd is empty when the panic happened outside
+	// of a command, the connection is closed without a reply in that case
+	PanicHandler func(client *Client, cmd string, value interface{}, stack []byte) error
+	panics       uint64
+
+	middleware []Middleware
+
+	// ACLFile is the file used by ACL LOAD and ACL SAVE
+	ACLFile string
+
+	// DefaultUser is the user authenticated by AUTH with only a password. New connections
+	// are authenticated as this user when it's enabled and has the nopass flag
+	DefaultUser string
+
+	// AuthBackoff delays the reply to a failed authentication attempt, the delay doubles
+	// with each consecutive failure for the same user from the same host up to
+	// MaxAuthBackoff, which defaults to 10 seconds
+	AuthBackoff    time.Duration
+	MaxAuthBackoff time.Duration
+
+	// AuthFailureHandler is called after each failed authentication attempt
+	AuthFailureHandler func(client *Client, user string)
+
+	authLock         sync.Mutex
+	authFailures     map[authSource]int
+	authFailureCount uint64
+
+	pubsub pubsub
+
+	watchLock sync.Mutex
+	watched   map[string]map[*Client]struct{}
 }
 
 func LoadX509KeyPair(certFile, keyFile string) (*tls.Config, error) {
@@ -61,66 +142,184 @@ func LoadX509KeyPair(certFile, keyFile string) (*tls.Config, error) {
 	}, nil
 }
 
+// Close stops accepting new connections and closes all active connections immediately,
+// see Shutdown to wait for in-flight commands
 func (s *Server) Close() error {
-	return s.s.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Closed = true
+	s.cancel()
+	err := s.s.Close()
+	for client := range s.clients {
+		client.Close()
+	}
+
+	return err
+}
+
+var (
+	clientType  = reflect.TypeOf(&Client{})
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
+// isArgumentType returns true when command arguments can be converted to the given type
+func isArgumentType(t reflect.Type) bool {
+	if t == valuePtrType {
+		return true
+	}
+
+	switch t.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.Struct:
+		return true
+	case reflect.Interface:
+		return t.NumMethod() == 0
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return isArgumentType(t.Elem())
+	case reflect.Map:
+		return isArgumentType(t.Key()) && isArgumentType(t.Elem())
+	}
+
+	return false
 }
 
-func extractCommands(ctx interface{}, lock *sync.Mutex) map[string]Command {
+// isReturnType returns true when a command return value can be converted using New
+func isReturnType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer, reflect.Complex64, reflect.Complex128:
+		return false
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return isReturnType(t.Elem())
+	case reflect.Map:
+		return isReturnType(t.Key()) && isReturnType(t.Elem())
+	}
+
+	return true
+}
+
+func convertArgument(arg *Value, t reflect.Type) (reflect.Value, error) {
+	if t == valuePtrType {
+		return reflect.ValueOf(arg), nil
+	}
+
+	dest := reflect.New(t)
+	if err := Unmarshal(arg, dest.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+
+	return dest.Elem(), nil
+}
+
+func extractCommands(ctx interface{}) map[string]Command {
 	commands := map[string]Command{}
 
 	typ := reflect.TypeOf(ctx)
 	val := reflect.ValueOf(ctx)
-	clientType := reflect.TypeOf(&Client{})
-	valueType := reflect.TypeOf(&Value{})
 	for i := 0; i < typ.NumMethod(); i++ {
 		method := typ.Method(i)
 		name := strings.ToLower(method.Name)
 
-		if method.Type.NumOut() != 1 {
+		// Commands return either an error or a value and an error
+		numOut := method.Type.NumOut()
+		if numOut == 0 || numOut > 2 || method.Type.Out(numOut-1) != errorType {
+			continue
+		} else if numOut == 2 && !isReturnType(method.Type.Out(0)) {
 			continue
 		}
 
-		if method.Type.Out(0).Name() != "error" {
+		// Commands may accept a context.Context before the *Client argument
+		first := 2
+		withContext := method.Type.NumIn() >= 3 && method.Type.In(1) == contextType
+		if withContext {
+			first = 3
+		}
+
+		if method.Type.NumIn() < first || method.Type.In(0) != typ || method.Type.In(first-1) != clientType {
 			continue
-		} else if method.Type.NumIn() >= 2 && method.Type.In(0) == typ && method.Type.In(1) == clientType {
-			variadic := method.Type.IsVariadic()
-
-			ok := true
-			for i := 2; i < method.Type.NumIn(); i++ {
-				if method.Type.In(i) != valueType {
-					if i == method.Type.NumIn()-1 && variadic && method.Type.In(i).Elem() == valueType {
-						continue
-					}
-					ok = false
-					break
-				}
-			}
-			if !ok {
-				continue
+		}
+
+		variadic := method.Type.IsVariadic()
+		params := []reflect.Type{}
+
+		ok := true
+		for i := first; i < method.Type.NumIn(); i++ {
+			t := method.Type.In(i)
+			if i == method.Type.NumIn()-1 && variadic {
+				t = t.Elem()
 			}
 
-			commands[name] = func(client *Client, args []*Value) error {
-				if !variadic && len(args) != method.Type.NumIn()-2 {
-					return client.WriteError(fmt.Sprintf("invalid argument count, expected %d but got %d", method.Type.NumIn()-2, len(args)))
-				}
-
-				lock.Lock()
-				defer lock.Unlock()
-
-				vargs := []reflect.Value{val}
-				vargs = append(vargs, reflect.ValueOf(client))
-				for _, arg := range args {
-					vargs = append(vargs, reflect.ValueOf(arg))
-				}
-				r := method.Func.Call(vargs)[0].Interface()
-				return fixReturnValue(r)
+			if !isArgumentType(t) {
+				ok = false
+				break
 			}
+
+			params = append(params, t)
 		}
+		if !ok {
+			continue
+		}
+
+		commands[name] = reflectCommand(val, method.Func, params, variadic, withContext)
 	}
 
 	return commands
 }
 
+func reflectCommand(val reflect.Value, f reflect.Value, params []reflect.Type, variadic, withContext bool) Command {
+	return func(client *Client, args []*Value) error {
+		if variadic && len(args) < len(params)-1 {
+			return client.WriteError(fmt.Sprintf("invalid argument count, expected at least %d but got %d", len(params)-1, len(args)))
+		} else if !variadic && len(args) != len(params) {
+			return client.WriteError(fmt.Sprintf("invalid argument count, expected %d but got %d", len(params), len(args)))
+		}
+
+		vargs := []reflect.Value{val}
+		if withContext {
+			vargs = append(vargs, reflect.ValueOf(client.Context()))
+		}
+		vargs = append(vargs, reflect.ValueOf(client))
+		for i, arg := range args {
+			t := params[len(params)-1]
+			if i < len(params) {
+				t = params[i]
+			}
+
+			x, err := convertArgument(arg, t)
+			if err != nil {
+				return client.WriteError(fmt.Sprintf("invalid argument %d: %s", i+1, err))
+			}
+
+			vargs = append(vargs, x)
+		}
+
+		out := f.Call(vargs)
+		if len(out) == 1 {
+			return fixReturnValue(out[0].Interface())
+		}
+
+		if err := fixReturnValue(out[1].Interface()); err != nil {
+			return err
+		}
+
+		return writeReturnValue(client, out[0].Interface())
+	}
+}
+
+func writeReturnValue(client *Client, r interface{}) error {
+	switch a := r.(type) {
+	case *Message:
+		return client.Write(a)
+	case Message:
+		return client.Write(&a)
+	default:
+		return client.WriteValue(New(a))
+	}
+}
+
 func fixReturnValue(r interface{}) error {
 	switch e := r.(type) {
 	case nil:
@@ -139,12 +338,23 @@ func NewServer(s net.Listener, ctx interface{}) (*Server, error) {
 
 	server := &Server{
 		Addr:    s.Addr().String(),
+		Mode:    s.Addr().Network(),
 		s:       s,
 		Context: ctx,
 		Users:   map[string]User{},
+		Specs:   map[string]CommandSpec{},
+		Limits:  DefaultLimits,
+		clients: map[*Client]struct{}{},
+		pubsub:  newPubsub(),
+		watched: map[string]map[*Client]struct{}{},
+
+		DefaultUser:    "default",
+		MaxAuthBackoff: 10 * time.Second,
+		authFailures:   map[authSource]int{},
 	}
 
-	server.Commands = extractCommands(ctx, &server.contextLock)
+	server.Commands = extractCommands(ctx)
+	server.ctx, server.cancel = context.WithCancel(context.Background())
 
 	return server, nil
 }
@@ -173,28 +383,158 @@ func (server *Server) Run() error {
 	for {
 		conn, err := server.s.Accept()
 		if err != nil {
+			if server.isClosed() {
+				return ErrServerClosed
+			}
 			return err
 		}
 
-		go server.handleClient(conn)
+		server.setKeepAlive(conn)
+
+		client := NewClientVersion(conn, "2")
+		client.WriteTimeout = server.WriteTimeout
+		client.Limits = server.Limits
+		client.User = server.defaultUser()
+		client.ctx, client.cancel = context.WithCancel(server.ctx)
+
+		if server.MaxClients > 0 && server.clientCount() >= server.MaxClients {
+			go rejectClient(client, "max number of clients reached")
+			continue
+		}
+
+		if !server.addClient(client) {
+			client.Close()
+			return ErrServerClosed
+		}
+
+		go server.handleClient(client)
+	}
+}
+
+func (s *Server) setKeepAlive(conn net.Conn) {
+	if s.KeepAlive == 0 {
+		return
+	}
+
+	// TLS connections wrap the underlying TCP connection
+	if c, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = c.NetConn()
+	}
+
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	if s.KeepAlive < 0 {
+		tcp.SetKeepAlive(false)
+		return
+	}
+
+	tcp.SetKeepAlive(true)
+	tcp.SetKeepAlivePeriod(s.KeepAlive)
+}
+
+// rejectClient writes an error as soon as the connection is accepted and closes it, Redis
+// does the same when maxclients is reached
+func rejectClient(client *Client, msg string) {
+	defer client.Close()
+
+	client.conn.SetDeadline(time.Now().Add(time.Second))
+	client.WriteError(msg)
+	client.Output.Flush()
+}
+
+func (s *Server) clientCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.clients)
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Closed
+}
+
+func (s *Server) addClient(client *Client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Closed {
+		return false
+	}
+
+	s.clients[client] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) removeClient(client *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.clients, client)
+}
+
+// Shutdown stops accepting new connections, closes idle connections and waits for
+// in-flight commands to finish. Clients are notified before their connection is closed.
+// If ctx is done before all connections are closed then the context of each running
+// command is cancelled and ctx.Err() is returned
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.Closed = true
+	err := s.s.Close()
+	clients := make([]*Client, 0, len(s.clients))
+	for client := range s.clients {
+		clients = append(clients, client)
+	}
+	s.mu.Unlock()
+
+	// Notices are written without holding the server lock, a slow client
+	// shouldn't block clients that are disconnecting
+	for _, client := range clients {
+		client.shutdown()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		// Cancel the context of any commands that are still running
+		s.cancel()
+		return ctx.Err()
 	}
 }
 
 func (s *Server) CheckUser(user *User) bool {
+	s.usersLock.RLock()
 	if len(s.Users) == 0 {
+		s.usersLock.RUnlock()
 		return true
 	}
 
 	if user == nil {
+		s.usersLock.RUnlock()
 		return false
 	}
 
 	u, ok := s.Users[user.Name]
-	if !ok {
+	s.usersLock.RUnlock()
+	if !ok || u.Disabled {
 		return false
 	}
 
-	if u.Name == user.Name && u.Password == user.Password {
+	// Passwords are checked without holding the lock, bcrypt hashes are slow to compare
+	if u.checkPassword(user.Password) {
 		user.Permissions = u.Permissions
 		return true
 	}
@@ -203,66 +543,109 @@ func (s *Server) CheckUser(user *User) bool {
 }
 
 func (s *Server) handleHello(client *Client, args []*Value) {
-	if len(args) == 0 {
-		client.WriteValue(NewError("malformed HELLO command"))
-		return
+	version := client.Version
+	if len(args) > 0 {
+		version = args[0].ToString()
+		args = args[1:]
 	}
 
-	client.Version = args[0].ToString()
-
-	if client.Version != "2" && client.Version != "3" {
+	if version != "2" && version != "3" {
 		client.WriteValue(NewValue(Error, "NOPROTO this protocol is not supported"))
 		return
 	}
 
-	if len(args) >= 3 {
-		client.User = &User{
-			Name:     args[1].ToString(),
-			Password: args[2].ToString(),
+	var user *User
+	name := client.Name
+
+	for len(args) > 0 {
+		opt := strings.ToLower(args[0].ToString())
+
+		if opt == "auth" && len(args) >= 3 {
+			user = &User{
+				Name:     args[1].ToString(),
+				Password: args[2].ToString(),
+			}
+			args = args[3:]
+		} else if opt == "setname" && len(args) >= 2 {
+			name = args[1].ToString()
+			args = args[2:]
+		} else {
+			client.WriteError(fmt.Sprintf("syntax error in HELLO option '%s'", args[0].ToString()))
+			return
 		}
+	}
 
-		if !s.CheckUser(client.User) {
-			client.WriteValue(NewError("auth failed"))
+	if user != nil {
+		if !s.authenticate(client, user) {
+			client.WriteValue(NewErrorNoPrefix(errWrongPass))
 			return
 		}
+
+		client.User = user
+	} else if !s.authenticated(client) {
+		client.WriteValue(NewErrorNoPrefix("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"))
+		return
+	}
+
+	client.Version = version
+	client.Name = name
+
+	proto := 2
+	if version == "3" {
+		proto = 3
 	}
 
 	client.WriteValue(NewMap(map[string]*Value{
 		"server":  NewString("merz"),
 		"version": NewInt(WormVersion),
-		"proto":   NewInt(3),
+		"proto":   NewInt(proto),
 	}))
 }
 
 func (s *Server) handleAuth(client *Client, args []*Value) {
-	if len(args) == 0 {
-		client.WriteValue(New(ErrNotEnoughArguments))
-	} else if len(args) == 1 {
-		client.User = &User{
-			Name:     "default",
+	var user *User
+
+	switch len(args) {
+	case 1:
+		user = &User{
+			Name:     s.DefaultUser,
 			Password: args[0].ToString(),
 		}
-	} else if len(args) == 2 {
-		client.User = &User{
+	case 2:
+		user = &User{
 			Name:     args[0].ToString(),
 			Password: args[1].ToString(),
 		}
+	default:
+		client.WriteError("wrong number of arguments for 'auth' command")
+		return
 	}
 
-	if !s.CheckUser(client.User) {
-		client.WriteValue(NewError("auth failed"))
+	// The client keeps its current user when authentication fails
+	if !s.authenticate(client, user) {
+		client.WriteValue(NewErrorNoPrefix(errWrongPass))
 		return
 	}
 
+	client.User = user
 	client.WriteOK()
 }
 
-func (s *Server) listCommands(client *Client) {
-	if !s.CheckUser(client.User) {
-		client.WriteValue(NewError("auth failed"))
-		return
-	}
+// handleReset returns the connection to the state of a new connection
+func (s *Server) handleReset(client *Client) {
+	client.resetTransaction()
+	s.unwatch(client)
+	s.removeSubscriber(client)
+
+	client.Version = "2"
+	client.Name = ""
+	client.attributes = nil
+	client.User = s.defaultUser()
+
+	client.WriteSimpleString("RESET")
+}
 
+func (s *Server) listCommands(client *Client) {
 	arr := []*Value{}
 
 	for k, _ := range s.Commands {
@@ -272,69 +655,261 @@ func (s *Server) listCommands(client *Client) {
 	client.WriteValue(New(arr))
 }
 
-func (s *Server) handleClient(conn net.Conn) {
-	r := bufio.NewReader(conn)
-	w := bufio.NewWriter(conn)
+func (s *Server) call(client *Client, cmd string, f Command, args []*Value) error {
+	ctx := client.Context()
+	if s.CommandTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.CommandTimeout)
+		defer cancel()
+	}
+
+	client.commandCtx = ctx
+	defer func() {
+		client.commandCtx = nil
+	}()
 
-	client := &Client{
-		Input:   r,
-		Output:  w,
-		conn:    conn,
-		Version: "2",
-		Data:    map[string]interface{}{},
+	// Commands run by EXEC are already holding the context lock
+	if !client.inExec {
+		unlock := s.lockCommand(cmd, args)
+		defer unlock()
 	}
+
+	stop := client.watchDisconnect()
+	defer stop()
+
+	err := f(client, args)
+
+	if spec, ok := s.Specs[cmd]; ok && !spec.ReadOnly {
+		s.Touch(spec.Keys(args)...)
+	}
+
+	return err
+}
+
+func (s *Server) handleClient(client *Client) {
+	defer s.wg.Done()
+	defer s.removeClient(client)
+	defer s.removeSubscriber(client)
+	defer s.unwatch(client)
 	defer client.Close()
 
-	for {
-		msg, err := client.Read()
-		if err != nil {
-			return
+	for s.serveCommand(client) {
+	}
+}
+
+// serveCommand reads and runs a single command, returning false if the connection should
+// be closed. Panics outside of commands, such as while parsing a message, only close the
+// connection that caused them
+func (s *Server) serveCommand(client *Client) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.recoverCommand(client, "", r)
+			ok = false
 		}
+	}()
 
-		args := msg.Value.ToArray()
-		if len(args) == 0 {
-			return
+	// Subscribers are allowed to wait for messages without sending commands
+	if s.IdleTimeout > 0 && client.subscriptionCount() == 0 {
+		client.conn.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+	} else if s.IdleTimeout > 0 {
+		client.conn.SetReadDeadline(time.Time{})
+	}
+
+	msg, err := client.Read()
+	if err != nil {
+		// The rest of the message can't be parsed so the connection is closed
+		if isProtocolError(err) {
+			client.writeLock.Lock()
+			client.WriteError(err.Error())
+			client.flush()
+			client.writeLock.Unlock()
 		}
+		return false
+	}
 
-		cmd := strings.ToLower(args[0].ToString())
-		args = args[1:]
+	if !client.beginCommand() {
+		return false
+	}
 
-		if client.User != nil && !client.User.Can(cmd) {
-			client.WriteValue(NewError("invalid permissions"))
-			client.Output.Flush()
-			continue
+	ok = func() bool {
+		client.writeLock.Lock()
+		defer client.writeLock.Unlock()
+
+		ok := s.handleMessage(client, msg)
+		return client.flush() == nil && ok
+	}()
+
+	return client.endCommand() && ok
+}
+
+// handleMessage runs a single command, returning false if the connection should be closed
+func (s *Server) handleMessage(client *Client, msg *Message) bool {
+	args := msg.Value.ToArray()
+	if len(args) == 0 {
+		return false
+	}
+
+	cmd := strings.ToLower(args[0].ToString())
+	args = args[1:]
+
+	if !noAuthCommands[cmd] && !s.authenticated(client) {
+		client.WriteValue(NewErrorNoPrefix("NOAUTH Authentication required."))
+		return true
+	}
+
+	if err := s.checkPermissions(client, cmd, args); err != nil {
+		client.WriteValue(NewErrorNoPrefix(err.Error()))
+		return true
+	}
+
+	if s.handleSubscriberMode(client, cmd) {
+		return true
+	}
+
+	if client.multi && !transactionCommands[cmd] {
+		s.queueCommand(client, cmd, args)
+		return true
+	}
+
+	ok, err := s.dispatch(client, cmd, args)
+	if err != nil {
+		client.Output.Reset(client.conn)
+		client.attributes = nil
+		client.WriteValue(NewError(err.Error()))
+	}
+
+	return ok
+}
+
+// Use adds middleware that runs around every command, middleware is run in the order
+// it was added
+func (s *Server) Use(m ...Middleware) {
+	s.middleware = append(s.middleware, m...)
+}
+
+// dispatch runs a command through the middleware chain, returning false if the
+// connection should be closed along with any error returned by the command
+func (s *Server) dispatch(client *Client, cmd string, args []*Value) (ok bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			ok, err = true, s.recoverCommand(client, cmd, r)
 		}
+	}()
 
-		f, ok := s.Commands[cmd]
-		if ok {
-			if !s.CheckUser(client.User) {
-				client.WriteValue(NewError("auth failed"))
-				client.Output.Flush()
-				continue
-			}
+	ok = true
+	next := func(client *Client, args []*Value) error {
+		var err error
+		ok, err = s.runCommand(client, cmd, args)
+		return err
+	}
 
-			if err = f(client, args); err != nil {
-				client.Output.Reset(conn)
-				client.WriteValue(NewError(err.Error()))
-			}
-		} else {
-			if cmd == "hello" {
-				s.handleHello(client, args)
-			} else if cmd == "auth" {
-				s.handleAuth(client, args)
-			} else if cmd == "command" {
-				s.listCommands(client)
-			} else if cmd == "ping" {
-				if len(args) > 0 {
-					client.WriteValue(args[0])
-				} else {
-					client.WriteValue(New("PONG"))
-				}
-			} else {
-				client.WriteValue(NewError("invalid command"))
-			}
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		m, inner := s.middleware[i], next
+		next = func(client *Client, args []*Value) error {
+			return m(cmd, client, args, inner)
 		}
+	}
+
+	err = next(client, args)
+	return ok, err
+}
+
+// runCommand runs a user-defined or builtin command
+func (s *Server) runCommand(client *Client, cmd string, args []*Value) (bool, error) {
+	f, ok := s.Commands[cmd]
+	if ok {
+		return true, s.call(client, cmd, f, args)
+	}
+
+	switch cmd {
+	case "hello":
+		s.handleHello(client, args)
+	case "auth":
+		s.handleAuth(client, args)
+	case "command":
+		s.listCommands(client)
+	case "ping":
+		s.handlePing(client, args)
+	case "subscribe":
+		s.subscribe(client, args, false)
+	case "psubscribe":
+		s.subscribe(client, args, true)
+	case "unsubscribe":
+		s.unsubscribe(client, args, false)
+	case "punsubscribe":
+		s.unsubscribe(client, args, true)
+	case "publish":
+		s.handlePublish(client, args)
+	case "multi":
+		s.handleMulti(client)
+	case "exec":
+		s.handleExec(client)
+	case "discard":
+		s.handleDiscard(client)
+	case "watch":
+		s.handleWatch(client, args)
+	case "unwatch":
+		s.unwatch(client)
+		client.WriteOK()
+	case "acl":
+		s.handleACL(client, args)
+	case "reset":
+		s.handleReset(client)
+	case "quit":
+		client.WriteOK()
+		return false, nil
+	default:
+		client.WriteValue(NewError("invalid command"))
+	}
+
+	return true, nil
+}
+
+// recoverCommand logs a command that panicked and returns the error sent to the client
+func (s *Server) recoverCommand(client *Client, cmd string, r interface{}) error {
+	stack := debug.Stack()
+	if cmd == "" {
+		log.Printf("panic handling client: %v\n%s", r, stack)
+	} else {
+		log.Printf("panic running command '%s': %v\n%s", cmd, r, stack)
+	}
+
+	s.mu.Lock()
+	s.panics += 1
+	s.mu.Unlock()
 
-		client.Output.Flush()
+	if s.PanicHandler != nil {
+		if err := s.PanicHandler(client, cmd, r, stack); err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("internal error running '%s'", cmd)
+}
+
+// PanicCount returns the number of commands that have panicked
+func (s *Server) PanicCount() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.panics
+}
+
+func (s *Server) handlePing(client *Client, args []*Value) {
+	// RESP2 clients with subscriptions receive pings in the same format as messages
+	if client.Version == "2" && client.subscriptionCount() > 0 {
+		msg := NewString("")
+		if len(args) > 0 {
+			msg = args[0]
+		}
+
+		client.WriteValue(NewArray([]*Value{NewString("pong"), msg}))
+		return
+	}
+
+	if len(args) > 0 {
+		client.WriteValue(args[0])
+	} else {
+		client.WriteValue(New("PONG"))
 	}
 }
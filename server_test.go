@@ -0,0 +1,1356 @@
+package worm
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type testContext struct {
+	total int64
+}
+
+func (c *testContext) Add(client *Client, n int64, names ...string) error {
+	c.total += n * int64(len(names))
+	return client.WriteValue(NewInt64(c.total))
+}
+
+func (c *testContext) Crash(client *Client) error {
+	panic("crash")
+}
+
+func call(t *testing.T, commands map[string]Command, name string, args ...*Value) *Value {
+	client := newTestClient()
+
+	f, ok := commands[name]
+	if !ok {
+		t.Fatal("Command not found:", name)
+	}
+
+	if err := f(client, args); err != nil {
+		t.Fatal(err)
+	}
+	client.Output.Flush()
+
+	v, err := client.ReadValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return v
+}
+
+func TestTypedArguments(t *testing.T) {
+	commands := extractCommands(&testContext{})
+
+	v := call(t, commands, "add", NewString("2"), NewString("a"), NewString("b"))
+	if v.ToInt64() != 4 {
+		t.Fatal("Invalid reply:", v)
+	}
+
+	v = call(t, commands, "add", NewString("x"))
+	if v.ToError() == nil || v.ToError().Error() != "ERR invalid argument 1: cannot unmarshal string into value of type int64" {
+		t.Fatal("Expected argument error:", v)
+	}
+}
+
+func (c *testContext) Wait(ctx context.Context, client *Client) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+type testResult struct {
+	Total int64    `worm:"total"`
+	Names []string `worm:"names"`
+}
+
+func (c *testContext) Result(client *Client, names ...string) (testResult, error) {
+	return testResult{Total: c.total, Names: names}, nil
+}
+
+func TestReturnValue(t *testing.T) {
+	commands := extractCommands(&testContext{total: 3})
+
+	v := call(t, commands, "result", NewString("a"))
+
+	var result testResult
+	if err := Unmarshal(v, &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Total != 3 || len(result.Names) != 1 || result.Names[0] != "a" {
+		t.Fatal("Invalid reply:", v)
+	}
+}
+
+func TestCommandSpecKeys(t *testing.T) {
+	args := []*Value{NewString("a"), NewString("1"), NewString("b"), NewString("2")}
+
+	keys := CommandSpec{FirstKey: 1, LastKey: -1, KeyStep: 2}.Keys(args)
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Fatal("Invalid keys:", keys)
+	}
+
+	keys = CommandSpec{FirstKey: 1}.Keys(args)
+	if len(keys) != 1 || keys[0] != "a" {
+		t.Fatal("Invalid keys:", keys)
+	}
+
+	if keys = (CommandSpec{}).Keys(args); len(keys) != 0 {
+		t.Fatal("Expected no keys:", keys)
+	}
+}
+
+// overlaps reports whether command b starts running while command a is still running
+func overlaps(policy LockPolicy, a, b []*Value) bool {
+	server := &Server{
+		LockPolicy: policy,
+		Specs: map[string]CommandSpec{
+			"read":  {ReadOnly: true, FirstKey: 1},
+			"write": {FirstKey: 1},
+		},
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	block := func(client *Client, args []*Value) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}
+
+	run := func(args []*Value) {
+		server.call(newTestClient(), args[0].ToString(), block, args[1:])
+	}
+
+	go run(a)
+	<-started
+
+	go run(b)
+
+	overlap := false
+	select {
+	case <-started:
+		overlap = true
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if !overlap {
+		<-started
+	}
+
+	return overlap
+}
+
+func TestLockPolicies(t *testing.T) {
+	cmd := func(args ...string) []*Value {
+		values := []*Value{}
+		for _, a := range args {
+			values = append(values, NewString(a))
+		}
+		return values
+	}
+
+	// Pick two keys that are guarded by different shards
+	other := "b"
+	for keyShards([]string{"a"})[0] == keyShards([]string{other})[0] {
+		other += "b"
+	}
+
+	tests := []struct {
+		policy  LockPolicy
+		a, b    []*Value
+		overlap bool
+	}{
+		{GlobalLock, cmd("read", "a"), cmd("read", "a"), false},
+		{NoLock, cmd("write", "a"), cmd("write", "a"), true},
+		{ReadWriteLock, cmd("read", "a"), cmd("read", "a"), true},
+		{ReadWriteLock, cmd("read", "a"), cmd("write", "a"), false},
+		{ReadWriteLock, cmd("write", "a"), cmd("write", other), false},
+		{KeyLock, cmd("write", "a"), cmd("write", "a"), false},
+		{KeyLock, cmd("write", "a"), cmd("write", other), true},
+		{KeyLock, cmd("read", "a"), cmd("read", "a"), true},
+		{KeyLock, cmd("read", "a"), cmd("write", "a"), false},
+	}
+
+	for i, test := range tests {
+		if overlaps(test.policy, test.a, test.b) != test.overlap {
+			t.Fatalf("Test %d: expected overlap to be %v", i, test.overlap)
+		}
+	}
+}
+
+func newTestServer(t *testing.T, ctx interface{}) (*Server, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(l, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Run()
+	}()
+
+	return server, done
+}
+
+func TestShutdown(t *testing.T) {
+	server, done := newTestServer(t, &testContext{})
+
+	client, err := ConnectV2(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if msg, err := client.Command("ping"); err != nil || msg.Value.ToString() != "PONG" {
+		t.Fatal("Invalid reply:", msg, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != ErrServerClosed {
+		t.Fatal("Expected ErrServerClosed:", err)
+	}
+
+	msg, err := client.Read()
+	if err != nil || msg.Value.ToError() == nil {
+		t.Fatal("Expected shutdown notice:", msg, err)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	server, _ := newTestServer(t, &testContext{})
+	defer server.Close()
+
+	server.CommandTimeout = time.Millisecond * 10
+
+	client, err := ConnectV2(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	msg, err := client.Command("wait")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Value.ToError() == nil || msg.Value.ToError().Error() != "ERR "+context.DeadlineExceeded.Error() {
+		t.Fatal("Expected deadline exceeded:", msg.Value)
+	}
+}
+
+func TestCommandDisconnect(t *testing.T) {
+	server, err := NewTCPServer("127.0.0.1:0", nil, &testContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	done := make(chan error, 1)
+	server.Use(func(cmd string, client *Client, args []*Value, next Command) error {
+		err := next(client, args)
+		if cmd == "wait" {
+			done <- err
+		}
+		return err
+	})
+	go server.Run()
+
+	client, err := ConnectV2(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.writeCommand("wait"); err != nil {
+		t.Fatal(err)
+	}
+	client.Output.Flush()
+
+	// The command is cancelled once the client disconnects
+	time.Sleep(time.Millisecond * 10)
+	client.Close()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatal("Expected command to be cancelled:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Command wasn't cancelled after disconnecting")
+	}
+}
+
+func TestPubsub(t *testing.T) {
+	server, _ := newTestServer(t, &testContext{})
+	defer server.Close()
+
+	sub, err := ConnectV2(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	for _, cmd := range []string{"subscribe", "psubscribe"} {
+		msg, err := sub.Command(cmd)
+		if err != nil || msg.Err() == nil || msg.Err().Error() != "ERR wrong number of arguments for '"+cmd+"' command" {
+			t.Fatal("Expected argument error:", msg, err)
+		}
+	}
+
+	// The connection isn't in subscriber mode
+	if msg, err := sub.Command("ping"); err != nil || msg.Value.ToString() != "PONG" {
+		t.Fatal("Invalid reply:", msg, err)
+	}
+
+	msg, err := sub.Command("psubscribe", "news.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a := msg.Value.ToArray(); len(a) != 3 || a[0].ToString() != "psubscribe" || a[2].ToInt() != 1 {
+		t.Fatal("Invalid subscribe reply:", msg.Value)
+	}
+
+	msg, err = sub.Command("add", "1")
+	if err != nil || msg.Value.ToError() == nil {
+		t.Fatal("Expected error in subscriber mode:", msg, err)
+	}
+
+	pub, err := ConnectV2(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	msg, err = pub.Command("publish", "news.tech", "hello")
+	if err != nil || msg.Value.ToInt() != 1 {
+		t.Fatal("Invalid publish reply:", msg, err)
+	}
+
+	if n := server.Publish("weather", NewString("sunny")); n != 0 {
+		t.Fatal("Expected no receivers:", n)
+	}
+
+	msg, err = sub.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := msg.Value.ToArray()
+	if len(a) != 4 || a[0].ToString() != "pmessage" || a[2].ToString() != "news.tech" || a[3].ToString() != "hello" {
+		t.Fatal("Invalid message:", msg.Value)
+	}
+}
+
+func TestPubsubDiscard(t *testing.T) {
+	server := &Server{pubsub: newPubsub()}
+	client := newTestClient()
+	client.Version = "2"
+
+	// Messages are queued while the client is handling UNSUBSCRIBE
+	client.writeLock.Lock()
+	server.subscribe(client, []*Value{NewString("a")}, false)
+	for i := 0; i < 3; i++ {
+		server.Publish("a", NewInt(i))
+	}
+	server.unsubscribe(client, nil, false)
+	client.flush()
+	client.writeLock.Unlock()
+
+	time.Sleep(time.Millisecond * 10)
+
+	client.writeLock.Lock()
+	defer client.writeLock.Unlock()
+
+	for _, kind := range []string{"subscribe", "unsubscribe"} {
+		msg, err := client.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if a := msg.Value.ToArray(); len(a) != 3 || a[0].ToString() != kind {
+			t.Fatal("Invalid reply:", msg.Value)
+		}
+	}
+
+	if msg, err := client.Read(); err == nil {
+		t.Fatal("Expected queued messages to be dropped:", msg.Value)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"news.*", "news.tech", true},
+		{"news.*", "weather", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"a*b*c", "aXbYc", true},
+		{"a*b*c", "aXbY", false},
+		{"\\*", "*", true},
+		{"\\*", "a", false},
+		{"a*a*a*a*a*a*a*a*a*a*a*a*b", strings.Repeat("a", 64), false},
+	}
+
+	for _, test := range tests {
+		if globMatch(test.pattern, test.s) != test.match {
+			t.Fatalf("Expected %q matching %q to be %v", test.pattern, test.s, test.match)
+		}
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	server, _ := newTestServer(t, &testContext{})
+	defer server.Close()
+
+	server.Specs["add"] = CommandSpec{FirstKey: 2, LastKey: -1}
+
+	a, err := ConnectV2(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	b, err := ConnectV2(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	for _, cmd := range [][]string{{"watch", "x"}, {"multi"}, {"add", "1", "x"}} {
+		if _, err := a.Command(cmd...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := b.Command("add", "1", "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := a.Command("exec")
+	if err != nil || !msg.Value.IsNil() {
+		t.Fatal("Expected transaction to be aborted:", msg, err)
+	}
+
+	for _, cmd := range [][]string{{"multi"}, {"add", "1", "y"}, {"ping"}} {
+		if _, err := a.Command(cmd...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg, err = a.Command("exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replies := msg.Value.ToArray()
+	if len(replies) != 2 || replies[0].ToInt() != 2 || replies[1].ToString() != "PONG" {
+		t.Fatal("Invalid exec reply:", msg.Value)
+	}
+}
+
+func TestExecAbortReply(t *testing.T) {
+	server := &Server{watched: map[string]map[*Client]struct{}{}}
+
+	for version, expected := range map[string]string{"2": "*-1\r\n", "3": "_\r\n"} {
+		client := newTestClient()
+		client.Version = version
+		client.multi = true
+		client.dirty = true
+
+		server.handleExec(client)
+		client.Output.Flush()
+
+		line, err := client.Input.ReadString('\n')
+		if err != nil || line != expected {
+			t.Fatalf("Invalid RESP%s reply: %q", version, line)
+		}
+	}
+}
+
+func TestUnixServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "worm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "worm.sock")
+
+	// Leave a stale socket behind
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	server, err := NewUnixServer(path, 0600, &testContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Run()
+
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatal("Invalid socket permissions:", info, err)
+	}
+
+	if _, err := NewUnixServer(path, 0600, &testContext{}); err == nil {
+		t.Fatal("Expected error for socket in use")
+	}
+
+	client, err := ConnectUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if msg, err := client.Command("ping"); err != nil || msg.Value.ToString() != "PONG" {
+		t.Fatal("Invalid reply:", msg, err)
+	}
+}
+
+func TestMultiListener(t *testing.T) {
+	listeners := []net.Listener{}
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	server, err := NewServer(newMultiListener(listeners), &testContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Run()
+	}()
+
+	for _, l := range listeners {
+		client, err := Connect(l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg, err := client.Command("ping"); err != nil || msg.Value.ToString() != "PONG" {
+			t.Fatal("Invalid reply:", msg, err)
+		}
+		client.Close()
+	}
+
+	server.Close()
+	if err := <-done; err != ErrServerClosed {
+		t.Fatal("Expected ErrServerClosed:", err)
+	}
+}
+
+func TestListenFDs(t *testing.T) {
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "1")
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+
+	// The descriptors were passed to a different process
+	if _, err := NewListenFDsServer(nil, &testContext{}); err != ErrNoListenFDs {
+		t.Fatal("Expected ErrNoListenFDs:", err)
+	}
+}
+
+func TestClientLimits(t *testing.T) {
+	server, err := NewTCPServer("127.0.0.1:0", nil, &testContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	server.MaxClients = 1
+	server.IdleTimeout = 100 * time.Millisecond
+	server.WriteTimeout = time.Second
+	server.KeepAlive = time.Minute
+	go server.Run()
+
+	client, err := Connect(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err := Connect(server.Addr); err == nil || err.Error() != "ERR max number of clients reached" {
+		t.Fatal("Expected max clients error:", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if _, err := client.Command("ping"); err == nil {
+		t.Fatal("Expected idle connection to be closed")
+	}
+
+	// The idle client has been removed so new clients are accepted again
+	again, err := Connect(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+
+	if msg, err := again.Command("ping"); err != nil || msg.Value.ToString() != "PONG" {
+		t.Fatal("Invalid reply:", msg, err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	server, err := NewTCPServer("127.0.0.1:0", nil, &testContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	server.WriteTimeout = 100 * time.Millisecond
+	server.Commands["big"] = func(client *Client, args []*Value) error {
+		return client.WriteValue(NewString(strings.Repeat("a", 64*1024*1024)))
+	}
+	go server.Run()
+
+	// The client never reads the reply
+	conn, err := net.Dial("tcp", server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("*1\r\n$3\r\nbig\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	client, err := ConnectV2(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Other commands wait for the context lock until the write times out
+	client.ReadTimeout = time.Second
+
+	if msg, err := client.Command("add", "1", "a"); err != nil || msg.Value.ToInt() != 1 {
+		t.Fatal("Invalid reply:", msg, err)
+	}
+}
+
+func TestProtocolLimits(t *testing.T) {
+	server, _ := newTestServer(t, &testContext{})
+	defer server.Close()
+
+	tests := []struct {
+		input string
+		err   error
+	}{
+		{"*1\r\n$9999999999\r\n", ErrBulkLength},
+		{"~-1\r\n", ErrAggregateLength},
+		{"%-1\r\n", ErrAggregateLength},
+		{"=3\r\ntxt\r\n", ErrBulkLength},
+	}
+
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", server.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client := NewClientVersion(conn, "2")
+
+		if _, err := conn.Write([]byte(test.input)); err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := client.Read()
+		if err != nil || msg.Err() == nil || msg.Err().Error() != "ERR "+test.err.Error() {
+			t.Fatalf("Expected protocol error for %q: %v %v", test.input, msg, err)
+		}
+
+		if _, err := client.Read(); err == nil {
+			t.Fatal("Expected connection to be closed")
+		}
+
+		client.Close()
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	server, err := NewTCPServer("127.0.0.1:0", nil, &testContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	handled := make(chan string, 1)
+	server.PanicHandler = func(client *Client, cmd string, value interface{}, stack []byte) error {
+		handled <- fmt.Sprint(cmd, ": ", value)
+		return nil
+	}
+	go server.Run()
+
+	client, err := Connect(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	msg, err := client.Command("crash")
+	if err != nil || msg.Err() == nil || msg.Err().Error() != "ERR internal error running 'crash'" {
+		t.Fatal("Expected error reply:", msg, err)
+	}
+
+	if h := <-handled; h != "crash: crash" {
+		t.Fatal("Invalid panic handler arguments:", h)
+	}
+
+	// The connection is still usable
+	if msg, err := client.Command("ping"); err != nil || msg.Value.ToString() != "PONG" {
+		t.Fatal("Invalid reply:", msg, err)
+	}
+
+	if server.PanicCount() != 1 {
+		t.Fatal("Expected a single panic:", server.PanicCount())
+	}
+}
+
+// panicReader simulates a parser bug triggered by a malformed frame
+type panicReader struct{}
+
+func (panicReader) Read(p []byte) (int, error) {
+	panic("malformed frame")
+}
+
+func TestClientPanicRecovery(t *testing.T) {
+	server, err := NewTCPServer("127.0.0.1:0", nil, &testContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	handled := make(chan string, 1)
+	server.PanicHandler = func(client *Client, cmd string, value interface{}, stack []byte) error {
+		handled <- fmt.Sprint(cmd, ": ", value)
+		return nil
+	}
+	go server.Run()
+
+	other, err := Connect(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	conn, remote := net.Pipe()
+	defer remote.Close()
+
+	client := NewClientVersion(conn, "2")
+	client.Input = bufio.NewReader(panicReader{})
+
+	server.wg.Add(1)
+	server.handleClient(client)
+
+	if h := <-handled; h != ": malformed frame" {
+		t.Fatal("Invalid panic handler arguments:", h)
+	}
+
+	if server.PanicCount() != 1 {
+		t.Fatal("Expected a single panic:", server.PanicCount())
+	}
+
+	// Only the connection that panicked is closed
+	if _, err := remote.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected connection to be closed")
+	}
+
+	if msg, err := other.Command("ping"); err != nil || msg.Value.ToString() != "PONG" {
+		t.Fatal("Invalid reply:", msg, err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	server, err := NewTCPServer("127.0.0.1:0", nil, &testContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	calls := make(chan string, 16)
+	server.Use(func(cmd string, client *Client, args []*Value, next Command) error {
+		calls <- cmd
+		return next(client, args)
+	}, func(cmd string, client *Client, args []*Value, next Command) error {
+		if cmd == "add" && len(args) > 0 && args[0].ToInt64() < 0 {
+			return errors.New("negative values are not allowed")
+		}
+		return next(client, args)
+	})
+	go server.Run()
+
+	client, err := Connect(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if msg, err := client.Command("add", "2", "a"); err != nil || msg.Value.ToInt64() != 2 {
+		t.Fatal("Invalid reply:", msg, err)
+	}
+
+	msg, err := client.Command("add", "-1", "a")
+	if err != nil || msg.Err() == nil || msg.Err().Error() != "ERR negative values are not allowed" {
+		t.Fatal("Expected error reply:", msg, err)
+	}
+
+	for _, expected := range []string{"hello", "add", "add"} {
+		if cmd := <-calls; cmd != expected {
+			t.Fatal("Expected", expected, "got", cmd)
+		}
+	}
+}
+
+func TestACLRules(t *testing.T) {
+	u := User{Name: "legacy", Password: "pw", Permissions: []string{"GET", "set"}}
+	if !u.Can("get") || u.Can("del") {
+		t.Fatal("Invalid legacy permissions")
+	}
+
+	if err := u.SetRules("+del", "~cache:*", "resetkeys", "~user:*"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"on", "#" + HashPassword("pw"), "~user:*", "-@all", "+get", "+set", "+del"}
+	if !reflect.DeepEqual(u.Rules(), expected) {
+		t.Fatal("Invalid rules:", u.Rules())
+	}
+
+	if !u.can("del", nil) || !u.canAccessKey("user:1") || u.canAccessKey("cache:1") {
+		t.Fatal("Invalid permissions:", u)
+	}
+
+	if err := u.SetRules("+@read", "-get"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !u.can("keys", []string{"read"}) || u.can("get", []string{"read"}) {
+		t.Fatal("Invalid category permissions:", u.Commands)
+	}
+
+	if err := u.SetRules("bogus"); err == nil || err.Error() != "Error in ACL SETUSER modifier 'bogus': Syntax error" {
+		t.Fatal("Expected syntax error:", err)
+	}
+
+	// The first key pattern restricts users that could access every key
+	u = User{Name: "legacy", Password: "pw"}
+	if !u.canAccessKey("user:1") {
+		t.Fatal("Expected access to every key")
+	}
+
+	if err := u.SetRules("~cache:*"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !u.canAccessKey("cache:1") || u.canAccessKey("user:1") {
+		t.Fatal("Invalid key permissions:", u.Keys)
+	}
+
+	if err := u.SetRules("#abc"); err == nil || !strings.Contains(err.Error(), "bcrypt") {
+		t.Fatal("Expected invalid hash error:", err)
+	}
+}
+
+func TestACL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "worm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server, err := NewTCPServer("127.0.0.1:0", nil, &testContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	server.Specs["add"] = CommandSpec{FirstKey: 2, LastKey: -1}
+	server.ACLFile = filepath.Join(dir, "users.acl")
+	server.SetUser(User{Name: "admin", Password: "admin"})
+	go server.Run()
+
+	admin, err := ConnectWithOptions(server.Addr, ConnectOptions{Username: "admin", Password: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	expectReply := func(client *Client, expected string, args ...string) {
+		t.Helper()
+
+		msg, err := client.Command(args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reply := msg.Value.ToString()
+		if msg.Err() != nil {
+			reply = msg.Err().Error()
+		}
+
+		if reply != expected {
+			t.Fatalf("Expected %q for %v: %q", expected, args, reply)
+		}
+	}
+
+	expectReply(admin, "OK", "acl", "setuser", "alice", "on", ">pw", "~a:*", "+@all", "-acl")
+
+	alice, err := ConnectWithOptions(server.Addr, ConnectOptions{Username: "alice", Password: "pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+
+	expectReply(alice, "1", "add", "1", "a:1")
+	expectReply(alice, "NOPERM this user has no permissions to access one of the keys used as arguments", "add", "1", "b:1")
+	expectReply(alice, "NOPERM this user has no permissions to run the 'acl' command", "acl", "whoami")
+
+	// Rules are applied to connections that are already authenticated
+	expectReply(admin, "OK", "acl", "setuser", "alice", "-@write")
+	expectReply(alice, "NOPERM this user has no permissions to run the 'add' command", "add", "1", "a:1")
+
+	expectReply(admin, "admin", "acl", "whoami")
+	expectReply(admin, "ERR Error in ACL SETUSER modifier 'bogus': Syntax error", "acl", "setuser", "alice", "bogus")
+
+	msg, err := admin.Command("acl", "getuser", "alice")
+	if err != nil || msg.Value.ToMap()["commands"].ToString() != "+@all -acl -@write" {
+		t.Fatal("Invalid user:", msg, err)
+	}
+
+	// New users are disabled until they're enabled using "on"
+	expectReply(admin, "OK", "acl", "setuser", "bob", ">pw", "+@all")
+	if _, err := ConnectWithOptions(server.Addr, ConnectOptions{Username: "bob", Password: "pw"}); err == nil {
+		t.Fatal("Expected disabled user to fail authentication")
+	}
+
+	expectReply(admin, "OK", "acl", "save")
+	expectReply(admin, "2", "acl", "deluser", "alice", "bob")
+	expectReply(admin, "OK", "acl", "load")
+
+	msg, err = admin.Command("acl", "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := []string{}
+	for _, v := range msg.Value.ToArray() {
+		list = append(list, v.ToString())
+	}
+
+	expected := []string{
+		"user admin on #" + HashPassword("admin") + " ~* +@all",
+		"user alice on #" + HashPassword("pw") + " ~a:* +@all -acl -@write",
+		"user bob off #" + HashPassword("pw") + " +@all",
+	}
+	if !reflect.DeepEqual(list, expected) {
+		t.Fatal("Invalid ACL list:", list)
+	}
+}
+
+func TestACLFirstUser(t *testing.T) {
+	server, _ := newTestServer(t, &testContext{})
+	defer server.Close()
+
+	client, err := ConnectV2(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	expectReply := func(client *Client, expected string, args ...string) {
+		t.Helper()
+
+		msg, err := client.Command(args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reply := msg.Value.ToString()
+		if msg.Err() != nil {
+			reply = msg.Err().Error()
+		}
+
+		if reply != expected {
+			t.Fatalf("Expected %q for %v: %q", expected, args, reply)
+		}
+	}
+
+	expectReply(client, "default", "acl", "whoami")
+	expectReply(client, "OK", "acl", "setuser", "alice", "on", ">pw", "+@all", "~*")
+
+	// Connections are still authenticated as the default user, which now has full access
+	expectReply(client, "default", "acl", "whoami")
+	expectReply(client, "1", "add", "1", "a")
+
+	other, err := ConnectV2(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	expectReply(other, "2", "add", "1", "a")
+
+	// Like Redis, disabling the default user only affects new connections
+	expectReply(client, "OK", "acl", "setuser", "default", "off")
+	expectReply(client, "3", "add", "1", "a")
+
+	other, err = ConnectV2(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	expectReply(other, "NOAUTH Authentication required.", "add", "1", "a")
+}
+
+func TestACLDefaultUserName(t *testing.T) {
+	server, err := NewTCPServer("127.0.0.1:0", nil, &testContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	server.DefaultUser = "guest"
+	go server.Run()
+
+	client, err := ConnectV2(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	expectReply := func(expected string, args ...string) {
+		t.Helper()
+
+		msg, err := client.Command(args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reply := msg.Value.ToString()
+		if msg.Err() != nil {
+			reply = msg.Err().Error()
+		}
+
+		if reply != expected {
+			t.Fatalf("Expected %q for %v: %q", expected, args, reply)
+		}
+	}
+
+	expectReply("guest", "acl", "whoami")
+	expectReply("OK", "acl", "setuser", "default", "on", ">pw", "+@all", "~*")
+	expectReply("guest", "acl", "whoami")
+	expectReply("ERR The 'guest' user cannot be removed", "acl", "deluser", "guest")
+	expectReply("1", "acl", "deluser", "default")
+}
+
+func TestPasswordHashes(t *testing.T) {
+	salted, err := HashPasswordBcrypt("salted", bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := User{Name: "alice", Password: "plain", Passwords: []string{HashPassword("hashed"), salted}}
+	for _, password := range []string{"plain", "hashed", "salted"} {
+		if !u.checkPassword(password) {
+			t.Fatal("Expected password to be accepted:", password)
+		}
+	}
+
+	if u.checkPassword("wrong") {
+		t.Fatal("Expected password to be rejected")
+	}
+
+	if err := u.SetRules("<salted", "!"+HashPassword("hashed"), "#"+HashPassword("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	if u.checkPassword("salted") || u.checkPassword("hashed") || !u.checkPassword("other") {
+		t.Fatal("Invalid passwords:", u.Passwords)
+	}
+
+	if err := u.SetRules("#invalid"); err == nil {
+		t.Fatal("Expected invalid hash error")
+	}
+
+	// Hashes that are too expensive to check are rejected
+	expensive := strings.Replace(salted, fmt.Sprintf("$%02d$", bcrypt.MinCost), "$31$", 1)
+	if err := u.SetRules("#" + expensive); err == nil {
+		t.Fatal("Expected invalid hash error")
+	}
+
+	if _, err := HashPasswordBcrypt("pw", maxBcryptCost+1); err == nil {
+		t.Fatal("Expected cost error")
+	}
+}
+
+func TestAuthFailures(t *testing.T) {
+	server, err := NewTCPServer("127.0.0.1:0", nil, &testContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	failures := make(chan string, 4)
+	server.AuthFailureHandler = func(client *Client, user string) {
+		failures <- user
+	}
+	server.AuthBackoff = 20 * time.Millisecond
+	server.SetUser(User{Name: "bob", Passwords: []string{HashPassword("secret")}})
+	go server.Run()
+
+	sub, err := ConnectWithOptions(server.Addr, ConnectOptions{Username: "bob", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if _, err := sub.Command("subscribe", AuthFailureChannel); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := ConnectV2(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		msg, err := client.Command("auth", "bob", "wrong")
+		if err != nil || msg.Err() == nil {
+			t.Fatal("Expected auth error:", msg, err)
+		}
+	}
+
+	// The second failure is delayed twice as long as the first
+	if time.Since(start) < 60*time.Millisecond {
+		t.Fatal("Expected failed attempts to be delayed:", time.Since(start))
+	}
+
+	if server.AuthFailures("bob") != 2 || server.AuthFailureCount() != 2 || <-failures != "bob" {
+		t.Fatal("Invalid failure count:", server.AuthFailures("bob"))
+	}
+
+	msg, err := sub.Read()
+	if err != nil || msg.Kind != Push || msg.Value.ToArray()[1].ToMap()["user"].ToString() != "bob" {
+		t.Fatal("Expected auth failure event:", msg, err)
+	}
+
+	if msg, err := client.Command("auth", "bob", "secret"); err != nil || msg.Err() != nil {
+		t.Fatal("Expected auth to succeed:", msg, err)
+	}
+
+	if server.AuthFailures("bob") != 0 {
+		t.Fatal("Expected failures to be reset")
+	}
+
+	// AUTH can't be queued, EXEC would delay failures while holding the context lock
+	client.Command("multi")
+	msg, err = client.Command("auth", "bob", "wrong")
+	if err != nil || msg.Err() == nil || msg.Err().Error() != "ERR Command not allowed inside a transaction" {
+		t.Fatal("Expected AUTH inside MULTI to fail:", msg, err)
+	}
+
+	msg, err = client.Command("exec")
+	if err != nil || msg.Err() == nil || !strings.HasPrefix(msg.Err().Error(), "EXECABORT") {
+		t.Fatal("Expected transaction to be aborted:", msg, err)
+	}
+}
+
+func TestAuthBackoff(t *testing.T) {
+	server := &Server{AuthBackoff: 5 * time.Second}
+	if server.authBackoff(1) != 5*time.Second || server.authBackoff(3) != 20*time.Second {
+		t.Fatal("Invalid backoff:", server.authBackoff(3))
+	}
+
+	// Doubling stops before the delay overflows
+	for _, n := range []int{32, 64, 1000} {
+		if server.authBackoff(n) <= 0 {
+			t.Fatal("Invalid backoff:", n, server.authBackoff(n))
+		}
+	}
+
+	server.MaxAuthBackoff = 10 * time.Second
+	if server.authBackoff(1000) != 10*time.Second {
+		t.Fatal("Expected backoff to be capped:", server.authBackoff(1000))
+	}
+}
+
+// remoteConn is a connection with a fixed remote address
+type remoteConn struct {
+	net.Conn
+	addr string
+}
+
+func (c remoteConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.addr)
+	return addr
+}
+
+func TestAuthFailureSources(t *testing.T) {
+	server, err := NewTCPServer("127.0.0.1:0", nil, &testContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	server.SetUser(User{Name: "bob", Password: "secret"})
+
+	auth := func(addr, password string) bool {
+		conn, _ := net.Pipe()
+		defer conn.Close()
+
+		client := NewClientVersion(remoteConn{conn, addr}, "2")
+		return server.authenticate(client, &User{Name: "bob", Password: password})
+	}
+
+	auth("10.0.0.1:1000", "wrong")
+	auth("10.0.0.1:1001", "wrong")
+	auth("10.0.0.2:1000", "wrong")
+
+	// Another host authenticating doesn't reset the failures of the first host
+	if !auth("10.0.0.2:1000", "secret") || server.AuthFailures("bob") != 2 {
+		t.Fatal("Invalid failure count:", server.AuthFailures("bob"))
+	}
+
+	// Reconnecting from the same host continues the backoff
+	auth("10.0.0.1:1002", "wrong")
+	if server.AuthFailures("bob") != 3 {
+		t.Fatal("Invalid failure count:", server.AuthFailures("bob"))
+	}
+
+	if !auth("10.0.0.1:1003", "secret") || server.AuthFailures("bob") != 0 {
+		t.Fatal("Expected failures to be reset:", server.AuthFailures("bob"))
+	}
+}
+
+func TestAuthStateMachine(t *testing.T) {
+	server, err := NewTCPServer("127.0.0.1:0", nil, &testContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	server.SetUser(User{Name: "bob", Password: "pw"})
+	go server.Run()
+
+	client, err := ConnectV2(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	expectReply := func(expected string, args ...string) {
+		t.Helper()
+
+		msg, err := client.Command(args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reply := msg.Value.ToString()
+		if msg.Err() != nil {
+			reply = msg.Err().Error()
+		}
+
+		if reply != expected {
+			t.Fatalf("Expected %q for %v: %q", expected, args, reply)
+		}
+	}
+
+	// Only a few commands are allowed before authenticating
+	expectReply("NOAUTH Authentication required.", "add", "1", "a")
+	expectReply("NOAUTH Authentication required.", "command")
+	expectReply("PONG", "ping")
+
+	if msg, err := client.Command("hello", "3"); err != nil || msg.Err() == nil || !strings.HasPrefix(msg.Err().Error(), "NOAUTH") {
+		t.Fatal("Expected HELLO without AUTH to fail:", msg, err)
+	}
+
+	expectReply("ERR wrong number of arguments for 'auth' command", "auth")
+	expectReply("WRONGPASS invalid username-password pair or user is disabled.", "auth", "bob", "wrong")
+	expectReply("NOAUTH Authentication required.", "add", "1", "a")
+
+	expectReply("OK", "auth", "bob", "pw")
+	expectReply("1", "add", "1", "a")
+	expectReply("bob", "acl", "whoami")
+
+	// RESET discards the transaction and the authenticated user
+	expectReply("OK", "multi")
+	expectReply("RESET", "reset")
+	expectReply("NOAUTH Authentication required.", "exec")
+
+	// A default user without a password is used for new connections and after RESET
+	if err := server.SetUserRules("default", "on", "nopass", "+@all", "-acl"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectReply("RESET", "reset")
+	expectReply("2", "add", "1", "b")
+	expectReply("NOPERM this user has no permissions to run the 'acl' command", "acl", "whoami")
+
+	// Failed attempts to authenticate again keep the current user
+	expectReply("WRONGPASS invalid username-password pair or user is disabled.", "auth", "bob", "wrong")
+	expectReply("3", "add", "1", "c")
+
+	expectReply("OK", "auth", "bob", "pw")
+	expectReply("bob", "acl", "whoami")
+
+	expectReply("RESET", "reset")
+	expectReply("NOPERM this user has no permissions to run the 'acl' command", "acl", "whoami")
+
+	other, err := ConnectV2(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if msg, err := other.Command("add", "1", "d"); err != nil || msg.Value.ToInt() != 4 {
+		t.Fatal("Expected default user to be authenticated:", msg, err)
+	}
+}
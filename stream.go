@@ -0,0 +1,148 @@
+package worm
+
+import (
+	"fmt"
+)
+
+// StringWriter writes a streamed string reply without knowing the total length up front,
+// each call to Write emits a single chunk. When the client is using RESP2 the chunks are
+// buffered and written as a single bulk string when the writer is closed
+type StringWriter struct {
+	client *Client
+	buf    []byte
+}
+
+func (c *Client) StreamString() (*StringWriter, error) {
+	w := &StringWriter{client: c}
+
+	if c.Version == "2" {
+		return w, nil
+	}
+
+	if err := c.writeAttributes(); err != nil {
+		return nil, err
+	}
+
+	_, err := c.Output.WriteString("$?\r\n")
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *StringWriter) Write(p []byte) (int, error) {
+	// A zero-length chunk marks the end of the stream
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if w.client.Version == "2" {
+		w.buf = append(w.buf, p...)
+		return len(p), nil
+	}
+
+	_, err := w.client.Output.WriteString(fmt.Sprint(";", len(p), "\r\n"))
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.client.Output.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return n, w.client.WriteCRLF()
+}
+
+func (w *StringWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *StringWriter) Close() error {
+	c := w.client
+
+	if c.Version == "2" {
+		if err := c.WriteStringHeader(len(w.buf)); err != nil {
+			return err
+		}
+
+		if _, err := c.Output.Write(w.buf); err != nil {
+			return err
+		}
+
+		w.buf = nil
+		return c.WriteCRLF()
+	}
+
+	_, err := c.Output.WriteString(";0\r\n")
+	return err
+}
+
+// AggregateWriter writes a streamed array, map or set reply one element at a time, the
+// stream is terminated by calling Close. Map elements are written as alternating keys
+// and values. When the client is using RESP2 the elements are buffered and written as
+// an array when the writer is closed, so streamed aggregates can't be nested in RESP2 mode
+type AggregateWriter struct {
+	client *Client
+	values []*Value
+}
+
+func (c *Client) streamAggregate(header string) (*AggregateWriter, error) {
+	w := &AggregateWriter{client: c}
+
+	if c.Version == "2" {
+		return w, nil
+	}
+
+	if err := c.writeAttributes(); err != nil {
+		return nil, err
+	}
+
+	_, err := c.Output.WriteString(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (c *Client) StreamArray() (*AggregateWriter, error) {
+	return c.streamAggregate("*?\r\n")
+}
+
+func (c *Client) StreamMap() (*AggregateWriter, error) {
+	return c.streamAggregate("%?\r\n")
+}
+
+func (c *Client) StreamSet() (*AggregateWriter, error) {
+	return c.streamAggregate("~?\r\n")
+}
+
+func (w *AggregateWriter) Write(values ...*Value) error {
+	if w.client.Version == "2" {
+		w.values = append(w.values, values...)
+		return nil
+	}
+
+	for _, v := range values {
+		if err := w.client.WriteValue(v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *AggregateWriter) Close() error {
+	c := w.client
+
+	if c.Version == "2" {
+		err := c.WriteValue(NewArray(w.values))
+		w.values = nil
+		return err
+	}
+
+	_, err := c.Output.WriteString(".\r\n")
+	return err
+}
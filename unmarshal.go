@@ -0,0 +1,379 @@
+package worm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	valueType    = reflect.TypeOf(Value{})
+	valuePtrType = reflect.TypeOf(&Value{})
+	timeType     = reflect.TypeOf(time.Time{})
+	bigIntType   = reflect.TypeOf(big.Int{})
+)
+
+// UnmarshalTypeError is returned by Unmarshal when a value can't be converted to
+// the destination type, Path describes where the value was found
+type UnmarshalTypeError struct {
+	Path string
+	Kind Kind
+	Type reflect.Type
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("cannot unmarshal %s into value of type %s", e.Kind, e.Type)
+	}
+
+	return fmt.Sprintf("cannot unmarshal %s into %s of type %s", e.Kind, e.Path, e.Type)
+}
+
+// Unmarshal stores the contents of v in the value pointed to by dst, struct fields are
+// matched using the `worm` tag, or their name if no tag is provided
+func Unmarshal(v *Value, dst interface{}) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("Expected non-nil pointer in call to Unmarshal")
+	}
+
+	return unmarshal(v, rv.Elem(), "")
+}
+
+func typeError(v *Value, dst reflect.Value, path string) error {
+	return &UnmarshalTypeError{
+		Path: path,
+		Kind: v.Kind,
+		Type: dst.Type(),
+	}
+}
+
+func unmarshal(v *Value, dst reflect.Value, path string) error {
+	if v == nil {
+		v = &NilValue
+	}
+
+	switch dst.Type() {
+	case valuePtrType:
+		dst.Set(reflect.ValueOf(v))
+		return nil
+	case valueType:
+		dst.Set(reflect.ValueOf(*v))
+		return nil
+	case timeType:
+		return unmarshalTime(v, dst, path)
+	case bigIntType:
+		return unmarshalBigInt(v, dst, path)
+	}
+
+	if dst.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			dst.Set(reflect.Zero(dst.Type()))
+			return nil
+		}
+
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+
+		return unmarshal(v, dst.Elem(), path)
+	}
+
+	if dst.Kind() == reflect.Interface {
+		if dst.NumMethod() != 0 {
+			return typeError(v, dst, path)
+		}
+
+		if x := v.ToInterface(); x != nil {
+			dst.Set(reflect.ValueOf(x))
+		} else {
+			dst.Set(reflect.Zero(dst.Type()))
+		}
+		return nil
+	}
+
+	if v.IsNil() {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+
+	switch dst.Kind() {
+	case reflect.Bool:
+		switch v.Kind {
+		case Bool, Int64:
+			dst.SetBool(v.ToBool())
+		case String, Bytes:
+			b, err := strconv.ParseBool(string(v.ToBytes()))
+			if err != nil {
+				return typeError(v, dst, path)
+			}
+			dst.SetBool(b)
+		default:
+			return typeError(v, dst, path)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch v.Kind {
+		case Int64:
+			i = v.ToInt64()
+		case Float64:
+			f := v.ToFloat64()
+			if f != math.Trunc(f) {
+				return typeError(v, dst, path)
+			}
+			i = int64(f)
+		case BigInt:
+			b := v.ToBigInt()
+			if !b.IsInt64() {
+				return typeError(v, dst, path)
+			}
+			i = b.Int64()
+		case String, Bytes:
+			n, err := strconv.ParseInt(string(v.ToBytes()), 10, 64)
+			if err != nil {
+				return typeError(v, dst, path)
+			}
+			i = n
+		default:
+			return typeError(v, dst, path)
+		}
+
+		if dst.OverflowInt(i) {
+			return typeError(v, dst, path)
+		}
+		dst.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var i uint64
+		switch v.Kind {
+		case Int64:
+			if v.ToInt64() < 0 {
+				return typeError(v, dst, path)
+			}
+			i = uint64(v.ToInt64())
+		case BigInt:
+			b := v.ToBigInt()
+			if !b.IsUint64() {
+				return typeError(v, dst, path)
+			}
+			i = b.Uint64()
+		case String, Bytes:
+			n, err := strconv.ParseUint(string(v.ToBytes()), 10, 64)
+			if err != nil {
+				return typeError(v, dst, path)
+			}
+			i = n
+		default:
+			return typeError(v, dst, path)
+		}
+
+		if dst.OverflowUint(i) {
+			return typeError(v, dst, path)
+		}
+		dst.SetUint(i)
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		switch v.Kind {
+		case Float64, Int64:
+			f = v.ToFloat64()
+		case BigInt:
+			f, _ = new(big.Float).SetInt(v.ToBigInt()).Float64()
+		case String, Bytes:
+			n, err := strconv.ParseFloat(string(v.ToBytes()), 64)
+			if err != nil {
+				return typeError(v, dst, path)
+			}
+			f = n
+		default:
+			return typeError(v, dst, path)
+		}
+
+		if dst.OverflowFloat(f) {
+			return typeError(v, dst, path)
+		}
+		dst.SetFloat(f)
+	case reflect.String:
+		switch v.Kind {
+		case String, Int64, Float64, BigInt, Bool:
+			dst.SetString(v.ToString())
+		case Bytes:
+			dst.SetString(string(v.ToBytes()))
+		default:
+			return typeError(v, dst, path)
+		}
+	case reflect.Slice:
+		if dst.Type().Elem().Kind() == reflect.Uint8 {
+			if !v.Is(String) && !v.Is(Bytes) {
+				return typeError(v, dst, path)
+			}
+
+			b := v.ToBytes()
+			dest := reflect.MakeSlice(dst.Type(), len(b), len(b))
+			reflect.Copy(dest, reflect.ValueOf(b))
+			dst.Set(dest)
+			return nil
+		}
+
+		if !v.Is(Array) && !v.Is(Set) {
+			return typeError(v, dst, path)
+		}
+
+		arr := v.ToArray()
+		dest := reflect.MakeSlice(dst.Type(), len(arr), len(arr))
+		for i, x := range arr {
+			if err := unmarshal(x, dest.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		dst.Set(dest)
+	case reflect.Array:
+		if !v.Is(Array) && !v.Is(Set) {
+			return typeError(v, dst, path)
+		}
+
+		arr := v.ToArray()
+		if len(arr) != dst.Len() {
+			return typeError(v, dst, path)
+		}
+
+		for i, x := range arr {
+			if err := unmarshal(x, dst.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if !isMapLike(v) {
+			return typeError(v, dst, path)
+		}
+
+		entries := v.ToMapEntries()
+		dest := reflect.MakeMapWithSize(dst.Type(), len(entries))
+		for _, e := range entries {
+			k := reflect.New(dst.Type().Key()).Elem()
+			p := fmt.Sprintf("%s[%s]", path, e.Key.ToString())
+			if err := unmarshal(e.Key, k, p); err != nil {
+				return err
+			}
+
+			x := reflect.New(dst.Type().Elem()).Elem()
+			if err := unmarshal(e.Value, x, p); err != nil {
+				return err
+			}
+
+			dest.SetMapIndex(k, x)
+		}
+		dst.Set(dest)
+	case reflect.Struct:
+		if !isMapLike(v) {
+			return typeError(v, dst, path)
+		}
+
+		typ := dst.Type()
+		for _, e := range v.ToMapEntries() {
+			name := e.Key.ToString()
+
+			i := fieldIndex(typ, name)
+			if i < 0 {
+				continue
+			}
+
+			p := typ.Field(i).Name
+			if path != "" {
+				p = path + "." + p
+			}
+
+			if err := unmarshal(e.Value, dst.Field(i), p); err != nil {
+				return err
+			}
+		}
+	default:
+		return typeError(v, dst, path)
+	}
+
+	return nil
+}
+
+// isMapLike reports whether a value can be decoded as a map, RESP2 replies send maps
+// as flat arrays of alternating keys and values
+func isMapLike(v *Value) bool {
+	if v.Is(Array) {
+		return len(v.ToArray())%2 == 0
+	}
+
+	return v.Is(Map)
+}
+
+// fieldIndex finds the struct field for the given key, preferring an exact match of
+// the `worm` tag or field name
+func fieldIndex(typ reflect.Type, name string) int {
+	fold := -1
+
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		k := field.Name
+		tag := field.Tag.Get("worm")
+		if tag == "-" {
+			continue
+		} else if tag != "" {
+			k = tag
+		}
+
+		if k == name {
+			return i
+		}
+
+		if fold < 0 && strings.EqualFold(k, name) {
+			fold = i
+		}
+	}
+
+	return fold
+}
+
+func unmarshalTime(v *Value, dst reflect.Value, path string) error {
+	var t time.Time
+
+	switch v.Kind {
+	case String, Bytes:
+		x, err := time.Parse(time.RFC3339Nano, string(v.ToBytes()))
+		if err != nil {
+			return typeError(v, dst, path)
+		}
+		t = x
+	case Int64:
+		t = time.Unix(v.ToInt64(), 0)
+	case Nil:
+	default:
+		return typeError(v, dst, path)
+	}
+
+	dst.Set(reflect.ValueOf(t))
+	return nil
+}
+
+func unmarshalBigInt(v *Value, dst reflect.Value, path string) error {
+	i := big.NewInt(0)
+
+	switch v.Kind {
+	case BigInt, Int64:
+		i.Set(v.ToBigInt())
+	case String, Bytes:
+		if _, ok := i.SetString(string(v.ToBytes()), 10); !ok {
+			return typeError(v, dst, path)
+		}
+	case Nil:
+	default:
+		return typeError(v, dst, path)
+	}
+
+	dst.Set(reflect.ValueOf(*i))
+	return nil
+}
@@ -10,7 +10,9 @@ import (
 	"log"
 	"math/big"
 	"reflect"
+	"sort"
 	"strconv"
+	"time"
 )
 
 type Kind int
@@ -26,6 +28,7 @@ const (
 	Error
 	Array
 	Map
+	Set
 )
 
 type Value struct {
@@ -33,6 +36,34 @@ type Value struct {
 	Data interface{}
 }
 
+var kindNames = []string{
+	Nil:     "nil",
+	Bool:    "bool",
+	Int64:   "int64",
+	Float64: "float64",
+	BigInt:  "bigint",
+	String:  "string",
+	Bytes:   "bytes",
+	Error:   "error",
+	Array:   "array",
+	Map:     "map",
+	Set:     "set",
+}
+
+func (k Kind) String() string {
+	if k < 0 || int(k) >= len(kindNames) {
+		return fmt.Sprintf("Kind(%d)", int(k))
+	}
+
+	return kindNames[k]
+}
+
+// MapEntry is a single key/value pair of a Map value, keys may be any kind of value
+type MapEntry struct {
+	Key   *Value
+	Value *Value
+}
+
 var NilValue = Value{Kind: Nil, Data: nil}
 
 func (v *Value) Encode(w io.Writer) error {
@@ -106,8 +137,29 @@ func NewArray(a []*Value) *Value {
 	return NewValue(Array, a)
 }
 
+func NewSet(a []*Value) *Value {
+	return NewValue(Set, a)
+}
+
+// NewMap creates a Map value from a Go map, entries are sorted by key
 func NewMap(m map[string]*Value) *Value {
-	return NewValue(Map, m)
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	entries := make([]MapEntry, len(keys))
+	for i, k := range keys {
+		entries[i] = MapEntry{Key: NewString(k), Value: m[k]}
+	}
+
+	return NewMapEntries(entries)
+}
+
+// NewMapEntries creates a Map value that preserves the order and kind of each key
+func NewMapEntries(entries []MapEntry) *Value {
+	return NewValue(Map, entries)
 }
 
 func NewNil() *Value {
@@ -130,6 +182,10 @@ func New(value interface{}) *Value {
 		return NewBool(a)
 	case big.Int:
 		return NewBigInt(&a)
+	case *big.Int:
+		return NewBigInt(a)
+	case time.Time:
+		return NewString(a.Format(time.RFC3339Nano))
 	case int64:
 		return NewInt64(a)
 	case int:
@@ -158,6 +214,8 @@ func New(value interface{}) *Value {
 		return NewArray(dest)
 	case map[string]*Value:
 		return NewMap(a)
+	case []MapEntry:
+		return NewMapEntries(a)
 	case map[string]interface{}:
 		dest := map[string]*Value{}
 		for k, v := range a {
@@ -169,47 +227,105 @@ func New(value interface{}) *Value {
 	case Message:
 		return a.Value
 	default:
-		val := reflect.ValueOf(a)
+		return newReflect(reflect.ValueOf(a))
+	}
+}
+
+func newReflect(val reflect.Value) *Value {
+	switch val.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if val.IsNil() {
+			return NewNil()
+		}
+		return New(val.Elem().Interface())
+	case reflect.Bool:
+		return NewBool(val.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NewInt64(val.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return NewInt64(int64(val.Uint()))
+	case reflect.Float32, reflect.Float64:
+		return NewFloat64(val.Float())
+	case reflect.String:
+		return NewString(val.String())
+	case reflect.Slice, reflect.Array:
+		if val.Kind() == reflect.Slice && val.IsNil() {
+			return NewNil()
+		}
 
-		if val.Kind() != reflect.Struct {
-			log.Printf("Unknown type in call to New %T\n", val)
-			return &NilValue
+		if val.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, val.Len())
+			reflect.Copy(reflect.ValueOf(b), val)
+			return NewBytes(b)
 		}
 
-		dest := map[string]*Value{}
+		dest := make([]*Value, val.Len())
+		for i := range dest {
+			dest[i] = New(val.Index(i).Interface())
+		}
+		return NewArray(dest)
+	case reflect.Map:
+		if val.IsNil() {
+			return NewNil()
+		}
+
+		dest := make([]MapEntry, 0, val.Len())
+		iter := val.MapRange()
+		for iter.Next() {
+			dest = append(dest, MapEntry{Key: New(iter.Key().Interface()), Value: New(iter.Value().Interface())})
+		}
+
+		// Sort entries to keep the output stable, like NewMap
+		sort.Slice(dest, func(i, j int) bool {
+			return dest[i].Key.ToString() < dest[j].Key.ToString()
+		})
+		return NewMapEntries(dest)
+	case reflect.Struct:
+		dest := make([]MapEntry, 0, val.NumField())
 		for i := 0; i < val.NumField(); i++ {
 			valueField := val.Field(i)
 			typeField := val.Type().Field(i)
+			if typeField.PkgPath != "" {
+				continue
+			}
+
 			k := typeField.Name
 			tag := typeField.Tag.Get("worm")
-			if tag != "" {
+			if tag == "-" {
+				continue
+			} else if tag != "" {
 				k = tag
 			}
 
-			dest[k] = New(valueField.Interface())
+			dest = append(dest, MapEntry{Key: NewString(k), Value: New(valueField.Interface())})
 		}
 
-		return NewMap(dest)
+		return NewMapEntries(dest)
 	}
+
+	log.Printf("Unknown type in call to New %s\n", val.Type())
+	return &NilValue
 }
 
 func (v *Value) Is(kind Kind) bool {
 	return v.Kind == kind
 }
 
-func (v *Value) ToMap() map[string]*Value {
+// ToMapEntries returns the key/value pairs of a Map, or of an Array containing
+// alternating keys and values
+func (v *Value) ToMapEntries() []MapEntry {
 	if v.Is(Map) {
-		return v.Data.(map[string]*Value)
+		return v.Data.([]MapEntry)
 	} else if v.Is(Array) {
 		arr := v.Data.([]*Value)
 		if len(arr)%2 != 0 {
 			return nil
 		}
 
-		dest := map[string]*Value{}
+		dest := make([]MapEntry, 0, len(arr)/2)
 
 		for i := 0; i < len(arr); i += 2 {
-			dest[arr[i].ToString()] = arr[i+1]
+			dest = append(dest, MapEntry{Key: arr[i], Value: arr[i+1]})
 		}
 
 		return dest
@@ -218,14 +334,31 @@ func (v *Value) ToMap() map[string]*Value {
 	return nil
 }
 
+// ToMap returns a Go map view of a Map value, keys are converted using ToString
+func (v *Value) ToMap() map[string]*Value {
+	entries := v.ToMapEntries()
+	if entries == nil {
+		return nil
+	}
+
+	dest := make(map[string]*Value, len(entries))
+
+	for _, e := range entries {
+		dest[e.Key.ToString()] = e.Value
+	}
+
+	return dest
+}
+
 func (v *Value) ToArray() []*Value {
-	if v.Is(Array) {
+	if v.Is(Array) || v.Is(Set) {
 		return v.Data.([]*Value)
 	} else if v.Is(Map) {
-		dest := []*Value{}
+		entries := v.Data.([]MapEntry)
+		dest := make([]*Value, 0, len(entries)*2)
 
-		for k, v := range v.Data.(map[string]*Value) {
-			dest = append(dest, NewString(k), v)
+		for _, e := range entries {
+			dest = append(dest, e.Key, e.Value)
 		}
 
 		return dest
@@ -234,6 +367,14 @@ func (v *Value) ToArray() []*Value {
 	return nil
 }
 
+func (v *Value) ToSet() []*Value {
+	if v.Is(Set) || v.Is(Array) {
+		return v.Data.([]*Value)
+	}
+
+	return nil
+}
+
 func (v *Value) ToBytes() []byte {
 	if v.Is(Bytes) {
 		return v.Data.([]byte)
@@ -336,6 +477,33 @@ func (v *Value) ToBool() bool {
 	return false
 }
 
+// ToInterface converts a value to the equivalent Go value, maps are converted to
+// map[string]interface{} and arrays or sets to []interface{}
+func (v *Value) ToInterface() interface{} {
+	switch v.Kind {
+	case Nil:
+		return nil
+	case Error:
+		return v.ToError()
+	case Array, Set:
+		arr := v.ToArray()
+		dest := make([]interface{}, len(arr))
+		for i, x := range arr {
+			dest[i] = x.ToInterface()
+		}
+		return dest
+	case Map:
+		entries := v.ToMapEntries()
+		dest := make(map[string]interface{}, len(entries))
+		for _, e := range entries {
+			dest[e.Key.ToString()] = e.Value.ToInterface()
+		}
+		return dest
+	}
+
+	return v.Data
+}
+
 func (v *Value) IsNil() bool {
 	return v.Is(Nil)
 }
@@ -351,5 +519,9 @@ func (v *Value) UnmarshalJSON(b []byte) error {
 }
 
 func (v Value) MarshalJSON() ([]byte, error) {
+	if v.Is(Map) {
+		return json.Marshal(v.ToMap())
+	}
+
 	return json.Marshal(v.Data)
 }
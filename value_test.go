@@ -0,0 +1,110 @@
+package worm
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type unmarshalInner struct {
+	Name string `worm:"name"`
+}
+
+type unmarshalExample struct {
+	A     int                       `worm:"a"`
+	B     float32                   `worm:"b"`
+	C     []interface{}             `worm:"c"`
+	Inner unmarshalInner            `worm:"inner"`
+	Ptr   *unmarshalInner           `worm:"ptr"`
+	Items []string                  `worm:"items"`
+	Index map[int64]*unmarshalInner `worm:"index"`
+	When  time.Time                 `worm:"when"`
+	Big   big.Int                   `worm:"big"`
+	Raw   *Value                    `worm:"raw"`
+}
+
+func TestUnmarshal(t *testing.T) {
+	when := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	b, _ := big.NewInt(0).SetString("123456789012345678901234567890", 10)
+
+	expected := unmarshalExample{
+		A:     1,
+		B:     2.5,
+		C:     []interface{}{true, "x"},
+		Inner: unmarshalInner{Name: "inner"},
+		Ptr:   &unmarshalInner{Name: "ptr"},
+		Items: []string{"a", "b"},
+		Index: map[int64]*unmarshalInner{1: {Name: "one"}},
+		When:  when,
+		Big:   *b,
+		Raw:   NewInt(5),
+	}
+
+	v := NewMapEntries([]MapEntry{
+		{Key: NewString("a"), Value: NewString("1")},
+		{Key: NewString("b"), Value: NewFloat64(2.5)},
+		{Key: NewString("c"), Value: NewArray([]*Value{NewBool(true), NewString("x")})},
+		{Key: NewString("inner"), Value: New(unmarshalInner{Name: "inner"})},
+		{Key: NewString("ptr"), Value: New(unmarshalInner{Name: "ptr"})},
+		{Key: NewString("items"), Value: NewSet([]*Value{NewString("a"), NewString("b")})},
+		{Key: NewString("index"), Value: NewMapEntries([]MapEntry{
+			{Key: NewInt(1), Value: New(unmarshalInner{Name: "one"})},
+		})},
+		{Key: NewString("when"), Value: New(when)},
+		{Key: NewString("big"), Value: NewBigInt(b)},
+		{Key: NewString("raw"), Value: NewInt(5)},
+	})
+
+	var dest unmarshalExample
+	if err := Unmarshal(v, &dest); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(expected, dest) {
+		t.Fatal("Invalid unmarshal:", dest)
+	}
+}
+
+func TestUnmarshalRESP2Map(t *testing.T) {
+	v := NewArray([]*Value{
+		NewString("a"), NewString("1"),
+		NewString("inner"), NewArray([]*Value{NewString("name"), NewString("x")}),
+		NewString("index"), NewArray([]*Value{NewString("2"), New(unmarshalInner{Name: "two"})}),
+	})
+
+	var dest unmarshalExample
+	if err := Unmarshal(v, &dest); err != nil {
+		t.Fatal(err)
+	}
+
+	if dest.A != 1 || dest.Inner.Name != "x" || dest.Index[2] == nil || dest.Index[2].Name != "two" {
+		t.Fatal("Invalid unmarshal:", dest)
+	}
+
+	// Odd length arrays can't be decoded as a map
+	var m map[string]string
+	if err := Unmarshal(NewArray([]*Value{NewString("a")}), &m); err == nil {
+		t.Fatal("Expected error decoding odd length array")
+	}
+}
+
+func TestUnmarshalError(t *testing.T) {
+	v := New(map[string]interface{}{
+		"inner": map[string]interface{}{
+			"name": []interface{}{1},
+		},
+	})
+
+	var dest unmarshalExample
+	err := Unmarshal(v, &dest)
+
+	typeErr, ok := err.(*UnmarshalTypeError)
+	if !ok {
+		t.Fatal("Expected UnmarshalTypeError:", err)
+	}
+
+	if typeErr.Path != "Inner.Name" || typeErr.Kind != Array {
+		t.Fatal("Invalid error:", err)
+	}
+}